@@ -0,0 +1,24 @@
+package main
+
+import "net/http"
+
+// purgeCacheHandler removes the ip given in the path from the memory cache of this replica and from the cache store,
+// e.g. DELETE /admin/cache/8.8.8.8, so its next lookup is fetched from web again.
+// The memory caches of the other replicas keep the ip until it expires there.
+func (h *ApiHandler) purgeCacheHandler(w http.ResponseWriter, r *http.Request) {
+	ip := pathParam(r, "ip")
+	if !validateIp(&ip) {
+		writeApiError(w, r, ErrInvalidIp)
+		return
+	}
+	ctx, cancel := withTimeout(r.Context(), h.config.CacheWriteTimeoutMs)
+	defer cancel()
+	h.memoryCache.Remove(ip)
+	if err := h.cache.Delete(ctx, ip); err != nil {
+		ctxLogger(r.Context(), h.logger).Errorf("Cannot purge the ip %s from the cache, got this error: %s", ip, err)
+		writeApiError(w, r, err)
+		return
+	}
+	ctxLogger(r.Context(), h.logger).Infof("Purged the ip %s from the cache.", ip)
+	w.WriteHeader(http.StatusNoContent)
+}
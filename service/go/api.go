@@ -1,203 +1,333 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"log"
 	"net"
 	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
 )
 
-type IpApiResponseBody struct {
-	Query   string
-	Status  string
-	Country string
-}
-
-type ApiSuccessResponseData struct {
-	Country string `json:"country"`
-}
+// ApiSuccessResponseData is the geolocation of the ip keyed by the json field names of GeoLocation.
+// Only the fields requested with the fields query parameter are included, all of them by default.
+type ApiSuccessResponseData map[string]interface{}
 
+// ApiErrorResponseData is the error envelope, code is one of the stable codes of apiErrorMappings.
 type ApiErrorResponseData struct {
-	Message string `json:"message"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+	// RetryAfter is the number of seconds after which the request can be retried, if known
+	RetryAfter int `json:"retry_after,omitempty"`
 }
 
-type IpCacheTableItem struct {
-	id      int
-	ip      string
-	country string
+// ApiReservedResponseData is returned for the ips in a reserved range, which have no geolocation.
+type ApiReservedResponseData struct {
+	Reserved bool   `json:"reserved"`
+	Range    string `json:"range"`
 }
 
 type ApiHandler struct {
-	db         *sql.DB
-	logger     *logrus.Logger
-	httpClient *http.Client
-	config     *AppConfig
-}
-
-// Declare Prometheus metrics
-var (
-	totalRequests = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "http_requests_total",
-			Help: "Total number of requests handled by the server",
-		},
-		[]string{"path", "status"},
-	)
-	requestDuration = prometheus.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "http_request_duration_seconds",
-			Help:    "Histogram of response durations",
-			Buckets: prometheus.DefBuckets,
-		},
-		[]string{"path"},
-	)
-	webserviceErrors = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "http_request_webservice_errors_total",
-			Help: "Errors inside the webservice when handling an http request",
-		},
-		[]string{"path", "error"},
-	)
-)
+	logger   *logrus.Logger
+	provider GeoProvider
+	cache    CacheStore
+	config   *AppConfig
+	// clientIPs finds the ip of the caller through the trusted proxies
+	clientIPs *ClientIPResolver
+	// memoryCache is the in-process cache tier in front of the database
+	memoryCache *LRUCache
+	// refreshing holds the ips which are being refreshed in the background
+	refreshing sync.Map
+	// lookups coalesces concurrent upstream lookups of the same ip
+	lookups lookupGroup
+	// writeBehind writes the fetched items to the cache store in the background
+	writeBehind *WriteBehindQueue
+}
 
 // Helper functions
-func writeSuccessResponse(w http.ResponseWriter, body *ApiSuccessResponseData) {
+func writeSuccessResponse(w http.ResponseWriter, body ApiSuccessResponseData) {
 	message, _ := json.Marshal(body)
+	w.Header().Set("Content-Type", "application/json")
 	w.Write(message)
 }
 
-func writeApiError(w http.ResponseWriter, errorMessage string, errorStatusCode int) {
-	message, _ := json.Marshal(ApiErrorResponseData{errorMessage})
-	w.WriteHeader(errorStatusCode)
-	w.Write(message)
+// withTimeout returns a context which is done after the given milliseconds, or only when ctx is if they are not positive.
+func withTimeout(ctx context.Context, timeoutMs int) (context.Context, context.CancelFunc) {
+	if timeoutMs <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Millisecond*time.Duration(timeoutMs))
 }
 
 func validateIp(ip *string) bool {
 	return net.ParseIP(*ip) != nil
 }
 
-func (h *ApiHandler) ipLocationHandler(w http.ResponseWriter, r *http.Request) {
-	timer := prometheus.NewTimer(requestDuration.WithLabelValues(r.URL.Path))
-	defer timer.ObserveDuration()
-	h.logger.Infof("Received request: Method=%s, URL=%s, Headers=%v", r.Method, r.URL.String(), r.Header)
-	// X-Real-IP is the IP of the client
-	ip := r.Header.Get("X-Real-IP")
+// geoLocationFields are the json field names of GeoLocation in their order of declaration.
+var geoLocationFields = func() []string {
+	locationType := reflect.TypeOf(GeoLocation{})
+	fields := make([]string, locationType.NumField())
+	for i := range fields {
+		fields[i] = strings.Split(locationType.Field(i).Tag.Get("json"), ",")[0]
+	}
+	return fields
+}()
+
+func isGeoLocationField(field string) bool {
+	for _, name := range geoLocationFields {
+		if name == field {
+			return true
+		}
+	}
+	return false
+}
+
+// parseFields reads the comma separated fields query parameter, e.g. fields=country_code,asn.
+// All the fields are returned when it is not given.
+func parseFields(r *http.Request) ([]string, error) {
+	param := r.URL.Query().Get("fields")
+	if param == "" {
+		return geoLocationFields, nil
+	}
+	var fields []string
+	for _, field := range strings.Split(param, ",") {
+		field = strings.TrimSpace(field)
+		if !isGeoLocationField(field) {
+			return nil, fmt.Errorf("%w: unknown field %q, the fields are: %s", ErrInvalidRequest, field, strings.Join(geoLocationFields, ", "))
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// selectFields returns the requested fields of the location.
+func selectFields(location *GeoLocation, fields []string) ApiSuccessResponseData {
+	raw, _ := json.Marshal(location)
+	var all map[string]interface{}
+	json.Unmarshal(raw, &all)
+	data := make(ApiSuccessResponseData, len(fields))
+	for _, field := range fields {
+		data[field] = all[field]
+	}
+	return data
+}
+
+// ipLookupHandler looks up the ip given in the path, e.g. GET /v1/ip/8.8.8.8.
+func (h *ApiHandler) ipLookupHandler(w http.ResponseWriter, r *http.Request) {
+	h.lookupAndRespond(w, r, pathParam(r, "ip"))
+}
+
+// callerLookupHandler looks up the ip of the caller.
+func (h *ApiHandler) callerLookupHandler(w http.ResponseWriter, r *http.Request) {
+	h.lookupAndRespond(w, r, h.clientIPs.ClientIP(r))
+}
+
+// lookupAndRespond writes the geolocation of the ip with the fields requested in r.
+func (h *ApiHandler) lookupAndRespond(w http.ResponseWriter, r *http.Request, ip string) {
+	path := routePattern(r)
+	log := ctxLogger(r.Context(), h.logger)
+	span := trace.SpanFromContext(r.Context())
+	fields, err := parseFields(r)
+	if err != nil {
+		writeApiError(w, r, err)
+		return
+	}
 	if !validateIp(&ip) {
-		h.logger.Errorf("Bad IP address given, returning error.")
-		statusCode := http.StatusBadRequest
-		totalRequests.WithLabelValues(r.URL.Path, fmt.Sprint(statusCode)).Inc()
-		writeApiError(w, "bad ip address", statusCode)
+		log.Infof("Bad IP address given, returning error.")
+		writeApiError(w, r, ErrInvalidIp)
+		return
+	}
+
+	// Reserved ips are answered locally, they would only fail upstream
+	if ipRange, reserved := classifyReservedIp(ip); reserved {
+		log.Debugf("Ip %s is in the reserved range %s, returning without lookup.", ip, ipRange)
+		reservedLookups.WithLabelValues(path, ipRange).Inc()
+		message, _ := json.Marshal(ApiReservedResponseData{true, ipRange})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(message)
 		return
 	}
 
-	h.logger.Infof("checking if the ip is in cache for ip: %s", ip)
-	country, err := h.getIPCountryFromCache(ip)
-	// If it was in cache, write the response and return
+	// The in-memory cache is checked first to spare the database the hot ips
+	if item, ok := h.memoryCache.Get(ip); ok {
+		log.Debugf("Ip %s was found in memory cache, returning the result.", ip)
+		span.SetAttributes(cacheResultKey.String("memory_hit"))
+		location, err := item.result()
+		h.writeLookupResult(w, r, location, err, fields)
+		return
+	}
+
+	log.Debugf("checking if the ip is in cache for ip: %s", ip)
+	item, err := h.getIPCountryFromCache(r.Context(), ip)
+	// If it was in cache and not expired, write the response and return
 	if err == nil {
-		h.logger.Infof("Ip %s was found in cache, returning the result.", ip)
-		totalRequests.WithLabelValues(r.URL.Path, fmt.Sprint(http.StatusOK)).Inc()
-		writeSuccessResponse(w, &ApiSuccessResponseData{*country})
+		switch item.freshness(time.Second * time.Duration(h.config.CacheStaleSecs)) {
+		case CacheFresh:
+			log.Debugf("Ip %s was found in cache, returning the result.", ip)
+			span.SetAttributes(cacheResultKey.String("hit"))
+			cacheRequests.WithLabelValues(h.cache.Name(), "hit").Inc()
+			h.memoryCache.Add(ip, item)
+			location, err := item.result()
+			h.writeLookupResult(w, r, location, err, fields)
+			return
+		case CacheStale:
+			log.Debugf("Ip %s was found stale in cache, returning the result and refreshing it.", ip)
+			span.SetAttributes(cacheResultKey.String("stale"))
+			cacheRequests.WithLabelValues(h.cache.Name(), "hit").Inc()
+			go h.refreshCache(path, ip)
+			location, err := item.result()
+			h.writeLookupResult(w, r, location, err, fields)
+			return
+		case CacheExpired:
+			log.Debugf("Ip %s was found expired in cache.", ip)
+		}
+	} else if !errors.Is(err, ErrCacheMiss) {
+		// The lookup can still be answered from web, so a cache failure is not fatal
+		log.Errorf("Cannot read the ip from cache, got this error: %s", err)
+		countError(path, err)
+	}
+	cacheRequests.WithLabelValues(h.cache.Name(), "miss").Inc()
+	span.SetAttributes(cacheResultKey.String("miss"))
+	// The client may be gone while the cache was read
+	if err := r.Context().Err(); err != nil {
+		log.Infof("Request for ip %s was canceled, not getting it from web.", ip)
+		writeApiError(w, r, err)
 		return
 	}
 
-	h.logger.Infof("Getting the country from web for ip: %s", ip)
+	log.Debugf("Getting the country from web for ip: %s", ip)
 	// If data was not in cache, get it from web
-	country, err = h.getIPCountryFromWeb(ip)
+	location, err := h.fetchAndCache(r.Context(), path, ip)
+	h.writeLookupResult(w, r, location, err, fields)
+}
+
+// writeLookupResult writes the requested fields of the location, or the error of the lookup.
+func (h *ApiHandler) writeLookupResult(w http.ResponseWriter, r *http.Request, location *GeoLocation, err error, fields []string) {
+	log := ctxLogger(r.Context(), h.logger)
+	if errors.Is(err, ErrLocationNotFound) {
+		log.Debugf("No location found for the ip, returning error: %s", err)
+		writeApiError(w, r, err)
+		return
+	}
+	if errors.Is(err, context.Canceled) {
+		log.Infof("Request was canceled by the client: %s", err)
+		writeApiError(w, r, err)
+		return
+	}
 	// if cannot get it from web, terminate the request and return error
 	if err != nil {
-		h.logger.Errorf("Cannot get the ip from web, got this error: %s", err)
-		statusCode := http.StatusInternalServerError
-		webserviceErrors.WithLabelValues(r.URL.Path, "web_fetch_error").Inc()
-		totalRequests.WithLabelValues(r.URL.Path, fmt.Sprint(statusCode)).Inc()
-		writeApiError(w, "internal error", statusCode)
+		log.Errorf("Cannot get the ip from web, got this error: %s", err)
+		writeApiError(w, r, err)
 		return
 	}
+	writeSuccessResponse(w, selectFields(location, fields))
+}
 
-	h.logger.Infof("Writing the data fetched from web to db.")
-	err = h.writeIpCountryToCache(ip, *country)
+// fetchAndCache gets the ip from web and writes it to the cache tiers, a LookupFailedError is cached as a negative item.
+// Concurrent calls for the same ip are coalesced into a single upstream call and a single db write, which is canceled
+// once all of the callers are gone. The caller returns early with the error of ctx if it is done.
+func (h *ApiHandler) fetchAndCache(ctx context.Context, path string, ip string) (*GeoLocation, error) {
+	log := ctxLogger(ctx, h.logger)
+	var executed atomic.Bool
+	result, err := h.lookups.Do(ctx, ip, func(ctx context.Context) (interface{}, error) {
+		executed.Store(true)
+		location, err := h.getIPCountryFromWeb(ctx, ip)
+		var lookupFailed *LookupFailedError
+		if errors.As(err, &lookupFailed) {
+			negativeTTL := time.Second * time.Duration(h.config.CacheNegativeTTLSecs)
+			h.memoryCache.Add(ip, &CacheItem{Ip: ip, ExpiresAt: time.Now().Add(negativeTTL), FailReason: lookupFailed.Reason})
+			log.Debugf("Queueing the failed lookup of ip %s to be written to db.", ip)
+			h.writeIpCountryToCache(ctx, CacheWrite{Ip: ip, FailReason: lookupFailed.Reason})
+			return nil, lookupFailed
+		}
+		if err != nil {
+			return nil, err
+		}
+		h.memoryCache.Add(ip, &CacheItem{Ip: ip, Location: *location})
+		log.Debugf("Queueing the data fetched from web to be written to db.")
+		h.writeIpCountryToCache(ctx, CacheWrite{Ip: ip, Location: *location})
+		return location, nil
+	})
+	if !executed.Load() {
+		log.Debugf("Lookup of ip %s was coalesced with a concurrent lookup.", ip)
+		coalescedLookups.Inc()
+	}
 	if err != nil {
-		h.logger.Errorf("Cannot write the data to db, got this error: %s", err)
-		webserviceErrors.WithLabelValues(r.URL.Path, "db_write_error").Inc()
-	}
-	totalRequests.WithLabelValues(r.URL.Path, fmt.Sprint(http.StatusOK)).Inc()
-	writeSuccessResponse(w, &ApiSuccessResponseData{*country})
-}
-
-// getIpCountryFromCache reads the cache to check whether the requested information exists and if so, it will return that.
-func (h *ApiHandler) getIPCountryFromCache(ip string) (*string, error) {
-	query := fmt.Sprintf("SELECT id, ip, country FROM %s WHERE ip =$1;", h.config.DBTableName)
-	h.logger.Infof("row query: %s", query)
-	row := h.db.QueryRow(query, ip)
-	var ipCacheTableItem IpCacheTableItem
-	err := row.Scan(&ipCacheTableItem.id, &ipCacheTableItem.ip, &ipCacheTableItem.country)
-	switch err {
-	case sql.ErrNoRows:
-		return nil, fmt.Errorf("getIpCountryFromCache %s: no such ip exist in table %s", ip, h.config.DBTableName)
-	case nil:
-		h.logger.Infof("Found row at db: {'id': %d, 'ip': %s, 'country': %s}", ipCacheTableItem.id, ipCacheTableItem.ip, ipCacheTableItem.country)
-		return &ipCacheTableItem.country, nil
-	default:
-		err := fmt.Errorf("Bad state at database execution, cannot run query: %s", query)
-		h.logger.Error(err)
 		return nil, err
 	}
+	return result.(*GeoLocation), nil
 }
 
-// writeIpCountryToCache writes the data fetched externally to the cache table in the db.
-func (h *ApiHandler) writeIpCountryToCache(ip string, country string) error {
-	query := fmt.Sprintf("INSERT INTO %s (ip, country) VALUES ('%s', '%s');", h.config.DBTableName, ip, country)
-	h.logger.Infof("Running insert query: %s", query)
-	_, err := h.db.Exec(query)
-	if err != nil {
-		return fmt.Errorf("writeIpCountryToCache: %s", err)
+// refreshCache fetches the ip from web and writes it to the cache, it is used to refresh stale items in the background.
+// Only one refresh per ip runs at a time.
+func (h *ApiHandler) refreshCache(path string, ip string) {
+	if _, running := h.refreshing.LoadOrStore(ip, struct{}{}); running {
+		return
+	}
+	defer h.refreshing.Delete(ip)
+	if _, err := h.fetchAndCache(context.Background(), path, ip); err != nil && !errors.Is(err, ErrLocationNotFound) {
+		h.logger.Errorf("Cannot refresh the stale ip %s from web, got this error: %s", ip, err)
+		countError(path, err)
 	}
-	return nil
 }
 
-// getIPCountryFromWeb gets the requested information from a public api and returns it to the app.
-func (h *ApiHandler) getIPCountryFromWeb(ip string) (*string, error) {
-	base_url := "http://ip-api.com"
-	// sample request: http://ip-api.com/json/24.48.0.1
-	requestUrl := fmt.Sprintf("%s/json/%s", base_url, ip)
-	res, err := h.httpClient.Get(requestUrl)
-	// Check if request was made ok
-	if err != nil {
-		log.Printf("Error when getting ip from: %s", base_url)
-		return nil, err
-	}
-	// Check status code if not return error
-	if res.StatusCode != http.StatusOK {
-		log.Printf("IP service is not responding in expected way, status code received: %d", res.StatusCode)
-		return nil, fmt.Errorf("Bad status code error")
+// getIpCountryFromCache reads the cache store to check whether the requested information exists and if so, it will return that.
+// The error is an ErrCacheMiss if the ip is not cached, and an ErrCacheUnavailable if the cache cannot be read.
+// The read is bounded by the cache read timeout.
+func (h *ApiHandler) getIPCountryFromCache(ctx context.Context, ip string) (item *CacheItem, err error) {
+	ctx, span := tracer.Start(ctx, "getIPCountryFromCache", trace.WithAttributes(cacheBackendKey.String(h.cache.Name())))
+	defer func() { endSpan(span, err) }()
+	ctx, cancel := withTimeout(ctx, h.config.CacheReadTimeoutMs)
+	defer cancel()
+	return h.cache.Get(ctx, ip)
+}
+
+// writeIpCountryToCache queues the data fetched externally to be written to the cache store in the background.
+// The memory cache still has the item if it is dropped, and it is fetched again once that expires.
+func (h *ApiHandler) writeIpCountryToCache(ctx context.Context, write CacheWrite) {
+	write.spanContext = trace.SpanContextFromContext(ctx)
+	if !h.writeBehind.Enqueue(write) {
+		ctxLogger(ctx, h.logger).Warnf("Cannot queue the item of ip %s to be written to db, it is dropped.", write.Ip)
 	}
-	// Close the body buffer
-	defer res.Body.Close()
-	// Read the buffer and create the response type
-	body, err := io.ReadAll(res.Body)
-	if err != nil {
-		log.Printf("Cannot read the response body.")
-		return nil, fmt.Errorf("Response body unreadable error")
+}
+
+// getIPCountryFromWeb gets the requested information from the configured geolocation provider and returns it to the app.
+// The error is a LookupFailedError if the provider has no location for the ip, and an ErrUpstreamUnavailable otherwise.
+// The lookup through all of the providers is bounded by the upstream lookup timeout.
+func (h *ApiHandler) getIPCountryFromWeb(ctx context.Context, ip string) (location *GeoLocation, err error) {
+	ctx, span := tracer.Start(ctx, "getIPCountryFromWeb")
+	defer func() { endSpan(span, err) }()
+	ctx, cancel := withTimeout(ctx, h.config.GeoLookupTimeoutMs)
+	defer cancel()
+	location, err = h.provider.Lookup(ctx, ip)
+	if errors.Is(err, ErrLocationNotFound) {
+		return nil, err
 	}
-	var data IpApiResponseBody
-	err = json.Unmarshal(body, &data)
 	if err != nil {
-		log.Printf("Cannot unmarshall the response json to the IpApiResponseBody type.")
-		return nil, err
+		return nil, fmt.Errorf("%w: getIPCountryFromWeb %s: provider %s: %w", ErrUpstreamUnavailable, ip, h.provider.Name(), err)
 	}
-	return &data.Country, nil
+	return location, nil
 }
 
-func NewApiHandler(db *sql.DB, logger *logrus.Logger, client *http.Client, config *AppConfig) *ApiHandler {
-	prometheus.MustRegister(totalRequests)
-	prometheus.MustRegister(webserviceErrors)
-	prometheus.MustRegister(requestDuration)
+func NewApiHandler(logger *logrus.Logger, provider GeoProvider, cache CacheStore, writeBehind *WriteBehindQueue, clientIPs *ClientIPResolver, config *AppConfig) *ApiHandler {
 	return &ApiHandler{
-		db, logger, client, config,
+		logger:      logger,
+		provider:    provider,
+		cache:       cache,
+		config:      config,
+		clientIPs:   clientIPs,
+		writeBehind: writeBehind,
+		memoryCache: NewLRUCache(
+			config.CacheLRUSize, time.Second*time.Duration(config.CacheLRUTTLSecs),
+		),
 	}
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// BatchLookupResult is the requested fields of the geolocation of a single ip in a batch lookup keyed by their json
+// field names, along with the ip itself, or the ip and the code and message of the error if it could not be found.
+type BatchLookupResult map[string]interface{}
+
+type BatchLookupResponseData struct {
+	Results []BatchLookupResult `json:"results"`
+}
+
+// batchLookupHandler answers POST requests with a json array of ips in the body, e.g. ["1.1.1.1", "8.8.8.8"].
+// The results are in the order of the requested ips, and a failed ip does not fail the whole request.
+func (h *ApiHandler) batchLookupHandler(w http.ResponseWriter, r *http.Request) {
+	fields, err := parseFields(r)
+	if err != nil {
+		writeApiError(w, r, err)
+		return
+	}
+	// An ip is at most 45 characters, the rest of the allowance is for the json syntax and whitespace
+	r.Body = http.MaxBytesReader(w, r.Body, int64(h.config.BatchMaxIps)*64+1024)
+	var ips []string
+	if err := json.NewDecoder(r.Body).Decode(&ips); err != nil {
+		ctxLogger(r.Context(), h.logger).Infof("Bad batch request body: %s", err)
+		writeApiError(w, r, fmt.Errorf("%w: request body must be a json array of ip addresses", ErrInvalidRequest))
+		return
+	}
+	if len(ips) == 0 || len(ips) > h.config.BatchMaxIps {
+		writeApiError(w, r, fmt.Errorf("%w: between 1 and %d ip addresses must be given", ErrInvalidRequest, h.config.BatchMaxIps))
+		return
+	}
+
+	// Each distinct valid ip is looked up only once, and the reserved ones are not looked up at all
+	path := routePattern(r)
+	var validIps []string
+	seen := map[string]bool{}
+	reserved := map[string]string{}
+	for _, ip := range ips {
+		if !validateIp(&ip) || seen[ip] {
+			continue
+		}
+		seen[ip] = true
+		if ipRange, ok := classifyReservedIp(ip); ok {
+			reservedLookups.WithLabelValues(path, ipRange).Inc()
+			reserved[ip] = ipRange
+			continue
+		}
+		validIps = append(validIps, ip)
+	}
+	locations, errs := h.lookupLocations(r.Context(), path, validIps)
+
+	results := make([]BatchLookupResult, len(ips))
+	for i, ip := range ips {
+		switch {
+		case !seen[ip]:
+			results[i] = batchLookupError(ErrInvalidIp)
+		case reserved[ip] != "":
+			results[i] = BatchLookupResult{"reserved": true, "range": reserved[ip]}
+		case errs[ip] != nil:
+			results[i] = batchLookupError(errs[ip])
+		default:
+			results[i] = BatchLookupResult(selectFields(locations[ip], fields))
+		}
+		results[i]["ip"] = ip
+	}
+	message, _ := json.Marshal(BatchLookupResponseData{results})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(message)
+}
+
+// batchLookupError is the result of an ip which could not be found, with the code and message of the error.
+func batchLookupError(err error) BatchLookupResult {
+	mapping := mapApiError(err)
+	return BatchLookupResult{"code": mapping.code, "error": mapping.responseMessage(err)}
+}
+
+// lookupLocations resolves the locations of the given valid and distinct ips. The cache tiers are read in bulk first,
+// and the misses are fetched from web concurrently with at most BatchConcurrency lookups at a time.
+// The ips the provider has no location for have a LookupFailedError, whether it was cached or not, and the ips which
+// were not looked up when ctx was done have its error.
+func (h *ApiHandler) lookupLocations(ctx context.Context, path string, ips []string) (map[string]*GeoLocation, map[string]error) {
+	log := ctxLogger(ctx, h.logger)
+	locations := make(map[string]*GeoLocation, len(ips))
+	errs := map[string]error{}
+	setResult := func(ip string, item *CacheItem) {
+		if location, err := item.result(); err != nil {
+			errs[ip] = err
+		} else {
+			locations[ip] = location
+		}
+	}
+
+	var pending []string
+	for _, ip := range ips {
+		if item, ok := h.memoryCache.Get(ip); ok {
+			setResult(ip, item)
+		} else {
+			pending = append(pending, ip)
+		}
+	}
+	if len(pending) == 0 {
+		return locations, errs
+	}
+
+	readCtx, cancel := withTimeout(ctx, h.config.CacheReadTimeoutMs)
+	items, err := h.cache.GetMany(readCtx, pending)
+	cancel()
+	if err != nil {
+		// The lookup can still be answered from web, so a cache failure is not fatal
+		log.Errorf("Cannot read the batch from cache, got this error: %s", err)
+		countError(path, err)
+	}
+	var misses []string
+	staleWindow := time.Second * time.Duration(h.config.CacheStaleSecs)
+	for _, ip := range pending {
+		item, ok := items[ip]
+		if !ok {
+			cacheRequests.WithLabelValues(h.cache.Name(), "miss").Inc()
+			misses = append(misses, ip)
+			continue
+		}
+		switch item.freshness(staleWindow) {
+		case CacheFresh:
+			cacheRequests.WithLabelValues(h.cache.Name(), "hit").Inc()
+			h.memoryCache.Add(ip, item)
+			setResult(ip, item)
+		case CacheStale:
+			cacheRequests.WithLabelValues(h.cache.Name(), "hit").Inc()
+			go h.refreshCache(path, ip)
+			setResult(ip, item)
+		default:
+			cacheRequests.WithLabelValues(h.cache.Name(), "miss").Inc()
+			misses = append(misses, ip)
+		}
+	}
+	log.Debugf("Batch of %d ips has %d cache misses, getting them from web.", len(ips), len(misses))
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, max(h.config.BatchConcurrency, 1))
+	for _, ip := range misses {
+		select {
+		case semaphore <- struct{}{}:
+		case <-ctx.Done():
+			mu.Lock()
+			errs[ip] = ctx.Err()
+			mu.Unlock()
+			continue
+		}
+		wg.Add(1)
+		go func(ip string) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			location, err := h.fetchAndCache(ctx, path, ip)
+			mu.Lock()
+			defer mu.Unlock()
+			if errors.Is(err, ErrLocationNotFound) {
+				errs[ip] = err
+				return
+			}
+			if err != nil {
+				log.Errorf("Cannot get the ip %s from web, got this error: %s", ip, err)
+				countError(path, err)
+				errs[ip] = err
+				return
+			}
+			locations[ip] = location
+		}(ip)
+	}
+	wg.Wait()
+	return locations, errs
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// CacheFreshness tells how a cached item should be used.
+type CacheFreshness int
+
+const (
+	// CacheFresh items are served as is.
+	CacheFresh CacheFreshness = iota
+	// CacheStale items are served while being refreshed in the background.
+	CacheStale
+	// CacheExpired items are not served, and the request blocks on a fresh lookup.
+	CacheExpired
+)
+
+// CacheItem is the location of an ip as stored in a CacheStore.
+type CacheItem struct {
+	Ip        string
+	Location  GeoLocation
+	CreatedAt time.Time
+	// ExpiresAt is zero for items written before expiry was tracked.
+	ExpiresAt time.Time
+	// FailReason is set for the negative items of the ips the provider has no location for, the location is empty.
+	FailReason string
+}
+
+// result returns the location of the item, or a LookupFailedError if it is a negative item.
+func (item *CacheItem) result() (*GeoLocation, error) {
+	if item.FailReason != "" {
+		return nil, &LookupFailedError{item.FailReason}
+	}
+	return &item.Location, nil
+}
+
+// freshness returns the freshness of the item, items are stale for staleWindow after they expire.
+// Items written before expiry was tracked have no expiry time and are considered expired.
+func (item *CacheItem) freshness(staleWindow time.Duration) CacheFreshness {
+	if item.ExpiresAt.IsZero() {
+		return CacheExpired
+	}
+	now := time.Now()
+	switch {
+	case now.Before(item.ExpiresAt):
+		return CacheFresh
+	case now.Before(item.ExpiresAt.Add(staleWindow)):
+		return CacheStale
+	default:
+		return CacheExpired
+	}
+}
+
+// CacheStore is a shared cache of ip locations, which is checked before calling the geolocation provider.
+type CacheStore interface {
+	// Name is the identifier of the store, used as the tier label of the cache metrics.
+	Name() string
+	// Get returns the cached item of the ip, or an ErrCacheMiss if the ip is not cached.
+	// The errors of the store itself are ErrCacheUnavailable errors.
+	Get(ctx context.Context, ip string) (*CacheItem, error)
+	// GetMany returns the cached items of the given ips keyed by ip, the ips which are not cached are left out.
+	GetMany(ctx context.Context, ips []string) (map[string]*CacheItem, error)
+	// SetMany caches the given items at once, replacing the items of their ips. The items expire after the configured
+	// ttl, and the negative ones after the configured negative ttl. The ips are expected to be distinct.
+	SetMany(ctx context.Context, writes []CacheWrite) error
+	// Delete removes the cached item of the ip, it is not an error if the ip is not cached.
+	Delete(ctx context.Context, ip string) error
+	// Ping checks that the store answers, it is used by the readiness checks.
+	Ping(ctx context.Context) error
+}
+
+// CacheWrite is an item to be written to a CacheStore, it is a negative item if FailReason is set.
+type CacheWrite struct {
+	Ip         string
+	Location   GeoLocation
+	FailReason string
+	// spanContext is the span of the lookup which fetched the item, linked from the span of the batch write
+	spanContext trace.SpanContext
+}
+
+// startQuery starts the span of a query of a cache store, e.g. SELECT ip_cache, and returns the function ending it
+// which also records the duration of the query.
+func startQuery(ctx context.Context, backend string, system attribute.KeyValue, operation string, collection string) (context.Context, func(err error)) {
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, operation+" "+collection,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(system, semconv.DBOperationName(operation), semconv.DBCollectionName(collection)),
+	)
+	return ctx, func(err error) {
+		observeWithTraceID(ctx, dbQueryDuration.WithLabelValues(backend, operation), time.Since(start).Seconds())
+		endSpan(span, err)
+	}
+}
+
+type IpCacheTableItem struct {
+	id         int
+	ip         string
+	location   GeoLocation
+	createdAt  time.Time
+	expiresAt  sql.NullTime
+	failReason string
+}
+
+// ipCacheTableColumns are the columns scanned by scanIpCacheTableItem, the location columns of the rows written
+// before they were added are null and read as empty.
+const ipCacheTableColumns = "id, ip, country, COALESCE(country_code, ''), COALESCE(region, ''), COALESCE(city, ''), " +
+	"COALESCE(lat, 0), COALESCE(lon, 0), COALESCE(timezone, ''), COALESCE(isp, ''), COALESCE(org, ''), COALESCE(asn, ''), " +
+	"created_at, expires_at, COALESCE(fail_reason, '')"
+
+func scanIpCacheTableItem(row interface{ Scan(...interface{}) error }) (*IpCacheTableItem, error) {
+	var item IpCacheTableItem
+	err := row.Scan(
+		&item.id, &item.ip, &item.location.Country, &item.location.CountryCode, &item.location.Region, &item.location.City,
+		&item.location.Lat, &item.location.Lon, &item.location.Timezone, &item.location.ISP, &item.location.Org, &item.location.ASN,
+		&item.createdAt, &item.expiresAt, &item.failReason,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+func (item *IpCacheTableItem) cacheItem() *CacheItem {
+	return &CacheItem{
+		Ip:         item.ip,
+		Location:   item.location,
+		CreatedAt:  item.createdAt,
+		ExpiresAt:  item.expiresAt.Time,
+		FailReason: item.failReason,
+	}
+}
+
+// PostgresCacheStore keeps the cache in a PostgreSQL table.
+type PostgresCacheStore struct {
+	db        *sql.DB
+	logger    *logrus.Logger
+	tableName string
+	ttl       time.Duration
+	// negativeTTL is the ttl of the negative items
+	negativeTTL time.Duration
+}
+
+func (s *PostgresCacheStore) Name() string {
+	return "postgres"
+}
+
+// Get reads the cache to check whether the requested information exists and if so, it will return that.
+// The caller decides whether the returned item is fresh enough to be used.
+func (s *PostgresCacheStore) Get(ctx context.Context, ip string) (item *CacheItem, err error) {
+	ctx, done := startQuery(ctx, s.Name(), semconv.DBSystemPostgreSQL, "SELECT", s.tableName)
+	defer func() { done(err) }()
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE ip =$1;", ipCacheTableColumns, s.tableName)
+	ctxLogger(ctx, s.logger).Debugf("row query: %s", query)
+	ipCacheTableItem, err := scanIpCacheTableItem(s.db.QueryRowContext(ctx, query, ip))
+	switch err {
+	case sql.ErrNoRows:
+		return nil, fmt.Errorf("getIpCountryFromCache %s: %w in table %s", ip, ErrCacheMiss, s.tableName)
+	case nil:
+		ctxLogger(ctx, s.logger).Debugf("Found row at db: {'id': %d, 'ip': %s, 'country': %s, 'expires_at': %v}", ipCacheTableItem.id, ipCacheTableItem.ip, ipCacheTableItem.location.Country, ipCacheTableItem.expiresAt.Time)
+		return ipCacheTableItem.cacheItem(), nil
+	default:
+		ctxLogger(ctx, s.logger).Errorf("Bad state at database execution, cannot run query: %s: %s", query, err)
+		return nil, fmt.Errorf("%w: getIpCountryFromCache %s: %w", ErrCacheUnavailable, ip, withContextError(ctx, err))
+	}
+}
+
+// GetMany reads the rows of all the given ips in a single query.
+func (s *PostgresCacheStore) GetMany(ctx context.Context, ips []string) (items map[string]*CacheItem, err error) {
+	ctx, done := startQuery(ctx, s.Name(), semconv.DBSystemPostgreSQL, "SELECT", s.tableName)
+	defer func() { done(err) }()
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE ip = ANY($1);", ipCacheTableColumns, s.tableName)
+	ctxLogger(ctx, s.logger).Debugf("rows query: %s", query)
+	rows, err := s.db.QueryContext(ctx, query, pq.Array(ips))
+	if err != nil {
+		ctxLogger(ctx, s.logger).Errorf("Bad state at database execution, cannot run query: %s: %s", query, err)
+		return nil, fmt.Errorf("%w: getIpCountriesFromCache: %w", ErrCacheUnavailable, withContextError(ctx, err))
+	}
+	defer rows.Close()
+	items = make(map[string]*CacheItem, len(ips))
+	for rows.Next() {
+		ipCacheTableItem, err := scanIpCacheTableItem(rows)
+		if err != nil {
+			return nil, fmt.Errorf("%w: getIpCountriesFromCache: %w", ErrCacheUnavailable, withContextError(ctx, err))
+		}
+		items[ipCacheTableItem.ip] = ipCacheTableItem.cacheItem()
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%w: getIpCountriesFromCache: %w", ErrCacheUnavailable, withContextError(ctx, err))
+	}
+	return items, nil
+}
+
+// upsertColumns is the number of parameters of each row of the upsert of SetMany.
+const upsertColumns = 13
+
+// maxUpsertRows is the most rows a single upsert can have, postgres allows at most 65535 parameters per query.
+const maxUpsertRows = 65535 / upsertColumns
+
+// SetMany writes the data fetched externally to the cache table in the db with multi-row upserts of up to maxUpsertRows rows.
+// The existing rows of the ips are replaced, the table name is validated in NewAppConfig and the values are passed as parameters.
+func (s *PostgresCacheStore) SetMany(ctx context.Context, writes []CacheWrite) (err error) {
+	if len(writes) == 0 {
+		return nil
+	}
+	ctx, done := startQuery(ctx, s.Name(), semconv.DBSystemPostgreSQL, "INSERT", s.tableName)
+	defer func() { done(err) }()
+	for start := 0; start < len(writes); start += maxUpsertRows {
+		if err := s.upsert(ctx, writes[start:min(start+maxUpsertRows, len(writes))]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upsert writes the rows of the writes with a single query.
+func (s *PostgresCacheStore) upsert(ctx context.Context, writes []CacheWrite) error {
+	const columns = upsertColumns
+	rows := make([]string, len(writes))
+	args := make([]interface{}, 0, len(writes)*columns)
+	for i, write := range writes {
+		params := make([]string, columns)
+		for j := range params {
+			params[j] = fmt.Sprintf("$%d", i*columns+j+1)
+		}
+		rows[i] = fmt.Sprintf("(%s, now(), now() + make_interval(secs => %s))", strings.Join(params[:columns-1], ", "), params[columns-1])
+		// The location of the negative rows is empty, and the fail reason of the others is null
+		var failReason *string
+		ttl := s.ttl
+		if write.FailReason != "" {
+			failReason = &write.FailReason
+			ttl = s.negativeTTL
+		}
+		location := write.Location
+		args = append(args,
+			write.Ip, location.Country, location.CountryCode, location.Region, location.City, location.Lat, location.Lon,
+			location.Timezone, location.ISP, location.Org, location.ASN, failReason, ttl.Seconds(),
+		)
+	}
+	query := fmt.Sprintf("INSERT INTO %s (ip, country, country_code, region, city, lat, lon, timezone, isp, org, asn, fail_reason, created_at, expires_at) "+
+		"VALUES %s "+
+		"ON CONFLICT (ip) DO UPDATE SET country = EXCLUDED.country, country_code = EXCLUDED.country_code, region = EXCLUDED.region, "+
+		"city = EXCLUDED.city, lat = EXCLUDED.lat, lon = EXCLUDED.lon, timezone = EXCLUDED.timezone, isp = EXCLUDED.isp, org = EXCLUDED.org, "+
+		"asn = EXCLUDED.asn, fail_reason = EXCLUDED.fail_reason, created_at = EXCLUDED.created_at, expires_at = EXCLUDED.expires_at;", s.tableName, strings.Join(rows, ", "))
+	ctxLogger(ctx, s.logger).Debugf("Running upsert query of %d rows on table %s", len(writes), s.tableName)
+	if _, err := s.db.ExecContext(ctx, query, args...); err != nil {
+		return fmt.Errorf("%w: writeIpCountryToCache: %w", ErrCacheUnavailable, withContextError(ctx, err))
+	}
+	return nil
+}
+
+// Delete removes the row of the ip from the cache table.
+func (s *PostgresCacheStore) Delete(ctx context.Context, ip string) (err error) {
+	ctx, done := startQuery(ctx, s.Name(), semconv.DBSystemPostgreSQL, "DELETE", s.tableName)
+	defer func() { done(err) }()
+	query := fmt.Sprintf("DELETE FROM %s WHERE ip = $1;", s.tableName)
+	if _, err := s.db.ExecContext(ctx, query, ip); err != nil {
+		return fmt.Errorf("%w: deleteIpFromCache %s: %w", ErrCacheUnavailable, ip, withContextError(ctx, err))
+	}
+	return nil
+}
+
+func (s *PostgresCacheStore) Ping(ctx context.Context) error {
+	if err := s.db.PingContext(ctx); err != nil {
+		return fmt.Errorf("%w: ping: %w", ErrCacheUnavailable, err)
+	}
+	return nil
+}
+
+func NewPostgresCacheStore(db *sql.DB, logger *logrus.Logger, tableName string, ttl time.Duration, negativeTTL time.Duration) *PostgresCacheStore {
+	return &PostgresCacheStore{db, logger, tableName, ttl, negativeTTL}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func newTestPostgresCacheStore(t *testing.T) (*PostgresCacheStore, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("cannot create the sql mock: %s", err)
+	}
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db.Close()
+	})
+	return NewPostgresCacheStore(db, newTestLogger(), "ip_cache", time.Hour, 10*time.Minute), mock
+}
+
+var ipCacheTableRowColumns = []string{"id", "ip", "country", "country_code", "region", "city", "lat", "lon", "timezone", "isp", "org", "asn", "created_at", "expires_at", "fail_reason"}
+
+func TestPostgresCacheStoreGet(t *testing.T) {
+	store, mock := newTestPostgresCacheStore(t)
+	createdAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	query := regexp.QuoteMeta("SELECT " + ipCacheTableColumns + " FROM ip_cache WHERE ip =$1;")
+	mock.ExpectQuery(query).WithArgs("24.48.0.1").WillReturnRows(sqlmock.NewRows(ipCacheTableRowColumns).
+		AddRow(1, "24.48.0.1", "Canada", "CA", "Quebec", "Montreal", 45.5, -73.6, "America/Toronto", "Videotron", "Videotron", "AS5769", createdAt, createdAt.Add(time.Hour), ""))
+	mock.ExpectQuery(query).WithArgs("10.0.0.1").WillReturnRows(sqlmock.NewRows(ipCacheTableRowColumns).
+		AddRow(2, "10.0.0.1", "", "", "", "", 0, 0, "", "", "", "", createdAt, createdAt.Add(10*time.Minute), "private range"))
+	mock.ExpectQuery(query).WithArgs("8.8.8.8").WillReturnRows(sqlmock.NewRows(ipCacheTableRowColumns))
+	mock.ExpectQuery(query).WithArgs("1.1.1.1").WillReturnError(errors.New("connection refused"))
+	ctx := context.Background()
+
+	item, err := store.Get(ctx, "24.48.0.1")
+	if err != nil {
+		t.Fatalf("Get failed: %s", err)
+	}
+	want := GeoLocation{Country: "Canada", CountryCode: "CA", Region: "Quebec", City: "Montreal", Lat: 45.5, Lon: -73.6,
+		Timezone: "America/Toronto", ISP: "Videotron", Org: "Videotron", ASN: "AS5769"}
+	if item.Location != want || !item.CreatedAt.Equal(createdAt) || !item.ExpiresAt.Equal(createdAt.Add(time.Hour)) {
+		t.Errorf("Get returned %+v, want the location %+v", item, want)
+	}
+
+	negative, err := store.Get(ctx, "10.0.0.1")
+	if err != nil {
+		t.Fatalf("Get of the negative row failed: %s", err)
+	}
+	if _, err := negative.result(); !errors.Is(err, ErrLocationNotFound) {
+		t.Errorf("negative row result is %v, want ErrLocationNotFound", err)
+	}
+
+	if _, err := store.Get(ctx, "8.8.8.8"); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("Get of a missing row returned %v, want ErrCacheMiss", err)
+	}
+	if _, err := store.Get(ctx, "1.1.1.1"); !errors.Is(err, ErrCacheUnavailable) {
+		t.Errorf("Get with a failing database returned %v, want ErrCacheUnavailable", err)
+	}
+}
+
+func TestPostgresCacheStoreGetMany(t *testing.T) {
+	store, mock := newTestPostgresCacheStore(t)
+	createdAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT " + ipCacheTableColumns + " FROM ip_cache WHERE ip = ANY($1);")).
+		WithArgs("{\"24.48.0.1\",\"8.8.8.8\",\"1.1.1.1\"}").
+		WillReturnRows(sqlmock.NewRows(ipCacheTableRowColumns).
+			AddRow(1, "24.48.0.1", "Canada", "CA", "", "", 0, 0, "", "", "", "", createdAt, createdAt.Add(time.Hour), "").
+			// Rows written before expiry was tracked have no expires_at
+			AddRow(2, "8.8.8.8", "United States", "", "", "", 0, 0, "", "", "", "", createdAt, nil, ""))
+
+	items, err := store.GetMany(context.Background(), []string{"24.48.0.1", "8.8.8.8", "1.1.1.1"})
+	if err != nil {
+		t.Fatalf("GetMany failed: %s", err)
+	}
+	if len(items) != 2 || items["24.48.0.1"].Location.Country != "Canada" || items["8.8.8.8"].Location.Country != "United States" {
+		t.Errorf("GetMany returned %v, want the rows of 24.48.0.1 and 8.8.8.8", items)
+	}
+	if !items["8.8.8.8"].ExpiresAt.IsZero() {
+		t.Errorf("ExpiresAt of a row without expires_at is %s, want zero", items["8.8.8.8"].ExpiresAt)
+	}
+}
+
+func TestPostgresCacheStoreSetMany(t *testing.T) {
+	store, mock := newTestPostgresCacheStore(t)
+	location := GeoLocation{Country: "Canada", CountryCode: "CA", City: "Montreal", Lat: 45.5, Lon: -73.6, ASN: "AS5769"}
+	// The negative rows have an empty location, the fail reason and the negative ttl
+	mock.ExpectExec(`INSERT INTO ip_cache \(ip, .*\) VALUES \(\$1, .*make_interval\(secs => \$13\)\), \(\$14, .*make_interval\(secs => \$26\)\) ON CONFLICT \(ip\) DO UPDATE`).
+		WithArgs(
+			"24.48.0.1", "Canada", "CA", "", "Montreal", 45.5, -73.6, "", "", "", "AS5769", nil, float64(3600),
+			"10.0.0.1", "", "", "", "", 0.0, 0.0, "", "", "", "", "private range", float64(600),
+		).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	err := store.SetMany(context.Background(), []CacheWrite{
+		{Ip: "24.48.0.1", Location: location},
+		{Ip: "10.0.0.1", FailReason: "private range"},
+	})
+	if err != nil {
+		t.Fatalf("SetMany failed: %s", err)
+	}
+}
+
+func TestPostgresCacheStoreSetManySplitsLargeBatches(t *testing.T) {
+	store, mock := newTestPostgresCacheStore(t)
+	// The first upsert has maxUpsertRows rows and the second one the single row left
+	lastParam := maxUpsertRows * upsertColumns
+	mock.ExpectExec(regexp.QuoteMeta("make_interval(secs => $" + strconv.Itoa(lastParam) + ")) ON CONFLICT")).WillReturnResult(sqlmock.NewResult(0, maxUpsertRows))
+	mock.ExpectExec(`VALUES \(\$1, [^()]*\$12, now\(\), now\(\) \+ make_interval\(secs => \$13\)\) ON CONFLICT`).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	writes := make([]CacheWrite, maxUpsertRows+1)
+	for i := range writes {
+		writes[i] = CacheWrite{Ip: "ip-" + strconv.Itoa(i)}
+	}
+	if err := store.SetMany(context.Background(), writes); err != nil {
+		t.Fatalf("SetMany failed: %s", err)
+	}
+}
+
+func TestPostgresCacheStoreSetManyError(t *testing.T) {
+	store, mock := newTestPostgresCacheStore(t)
+	mock.ExpectExec("INSERT INTO ip_cache").WillReturnError(errors.New("value too long"))
+	if err := store.SetMany(context.Background(), []CacheWrite{{Ip: "24.48.0.1"}}); !errors.Is(err, ErrCacheUnavailable) {
+		t.Errorf("SetMany returned %v, want ErrCacheUnavailable", err)
+	}
+	if err := store.SetMany(context.Background(), nil); err != nil {
+		t.Errorf("SetMany of no writes returned %v", err)
+	}
+}
+
+func TestPostgresCacheStoreDelete(t *testing.T) {
+	store, mock := newTestPostgresCacheStore(t)
+	query := regexp.QuoteMeta("DELETE FROM ip_cache WHERE ip = $1;")
+	mock.ExpectExec(query).WithArgs("24.48.0.1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(query).WithArgs("8.8.8.8").WillReturnError(errors.New("connection refused"))
+
+	if err := store.Delete(context.Background(), "24.48.0.1"); err != nil {
+		t.Errorf("Delete failed: %s", err)
+	}
+	if err := store.Delete(context.Background(), "8.8.8.8"); !errors.Is(err, ErrCacheUnavailable) {
+		t.Errorf("Delete with a failing database returned %v, want ErrCacheUnavailable", err)
+	}
+}
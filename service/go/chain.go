@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// BreakerState is the state of a CircuitBreaker, its value is exported as is in the breaker state gauge.
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// CircuitBreaker stops calling a failing provider for a cooldown period.
+// It opens after threshold consecutive failures, and after the cooldown lets a single probe request through
+// in the half-open state, which closes the breaker on success or opens it again on failure.
+type CircuitBreaker struct {
+	name      string
+	logger    *logrus.Logger
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// Allow reports whether a request may be sent to the provider.
+func (b *CircuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(BreakerHalfOpen)
+		b.probing = true
+		return true
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// Success records a successful request and closes the breaker.
+func (b *CircuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.probing = false
+	b.setState(BreakerClosed)
+}
+
+// Failure records a failed request and opens the breaker if the threshold is reached or the probe failed.
+func (b *CircuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.probing = false
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		b.openedAt = time.Now()
+		b.setState(BreakerOpen)
+	}
+}
+
+// Release ends a request which was not answered by the provider, e.g. because its rate limit is reached,
+// without counting it as a success or a failure.
+func (b *CircuitBreaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// State returns the current state of the breaker, an open breaker whose cooldown is over is half-open
+// since it lets the next request through.
+func (b *CircuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.cooldown {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+func (b *CircuitBreaker) setState(state BreakerState) {
+	if b.state != state {
+		b.logger.Warnf("Circuit breaker of provider %s changed state from %s to %s", b.name, b.state, state)
+	}
+	b.state = state
+	providerBreakerState.WithLabelValues(b.name).Set(float64(state))
+}
+
+func NewCircuitBreaker(name string, logger *logrus.Logger, threshold int, cooldown time.Duration) *CircuitBreaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	breaker := &CircuitBreaker{name: name, logger: logger, threshold: threshold, cooldown: cooldown}
+	providerBreakerState.WithLabelValues(name).Set(float64(BreakerClosed))
+	return breaker
+}
+
+// ProviderChain is a GeoProvider that tries an ordered list of providers until one of them answers.
+// Providers whose circuit breaker is open are skipped.
+type ProviderChain struct {
+	providers []GeoProvider
+	breakers  []*CircuitBreaker
+	logger    *logrus.Logger
+}
+
+func (c *ProviderChain) Name() string {
+	return "chain"
+}
+
+func (c *ProviderChain) Lookup(ctx context.Context, ip string) (*GeoLocation, error) {
+	log := ctxLogger(ctx, c.logger)
+	var errs []error
+	for i, provider := range c.providers {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		breaker := c.breakers[i]
+		if !breaker.Allow() {
+			trace.SpanFromContext(ctx).AddEvent("circuit breaker is open", trace.WithAttributes(geoProviderKey.String(provider.Name())))
+			errs = append(errs, fmt.Errorf("%s: circuit breaker is open", provider.Name()))
+			continue
+		}
+		providerCtx, span := tracer.Start(ctx, "lookup "+provider.Name(), trace.WithAttributes(geoProviderKey.String(provider.Name())))
+		location, err := provider.Lookup(providerCtx, ip)
+		endSpan(span, err)
+		if errors.Is(err, ErrLocationNotFound) {
+			// The provider is healthy and has answered, so the next providers are not asked
+			breaker.Success()
+			return nil, err
+		}
+		if ctx.Err() != nil {
+			// The lookup was abandoned by the caller, which says nothing about the provider
+			breaker.Release()
+			errs = append(errs, fmt.Errorf("%s: %w", provider.Name(), withContextError(ctx, err)))
+			break
+		}
+		if errors.Is(err, ErrUpstreamRateLimited) {
+			// The provider is not failing, it is only asked to wait, so the next provider is tried
+			breaker.Release()
+			log.Warnf("Provider %s rate limit is reached for ip %s, trying the next provider: %s", provider.Name(), ip, err)
+			errs = append(errs, fmt.Errorf("%s: %w", provider.Name(), err))
+			continue
+		}
+		if err != nil {
+			breaker.Failure()
+			log.Warnf("Provider %s failed for ip %s, trying the next provider: %s", provider.Name(), ip, err)
+			errs = append(errs, fmt.Errorf("%s: %w", provider.Name(), err))
+			continue
+		}
+		breaker.Success()
+		// The provider which answered is recorded on the span of the whole lookup
+		trace.SpanFromContext(ctx).SetAttributes(geoProviderKey.String(provider.Name()))
+		return location, nil
+	}
+	return nil, fmt.Errorf("all providers failed: %w", errors.Join(errs...))
+}
+
+// Close closes every provider in the chain which holds resources.
+func (c *ProviderChain) Close() error {
+	var errs []error
+	for _, provider := range c.providers {
+		if closer, ok := provider.(io.Closer); ok {
+			errs = append(errs, closer.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// NewProviderChain creates the providers with the given names in order, each guarded by its own circuit breaker.
+func NewProviderChain(names []string, logger *logrus.Logger, create func(name string) (GeoProvider, error), thresholds map[string]int, defaultThreshold int, cooldowns map[string]int, defaultCooldownSecs int) (*ProviderChain, error) {
+	if len(names) == 0 {
+		return nil, fmt.Errorf("at least one geolocation provider must be configured")
+	}
+	chain := &ProviderChain{logger: logger}
+	for _, name := range names {
+		provider, err := create(name)
+		if err != nil {
+			chain.Close()
+			return nil, err
+		}
+		threshold, ok := thresholds[name]
+		if !ok {
+			threshold = defaultThreshold
+		}
+		cooldownSecs, ok := cooldowns[name]
+		if !ok {
+			cooldownSecs = defaultCooldownSecs
+		}
+		chain.providers = append(chain.providers, provider)
+		chain.breakers = append(chain.breakers, NewCircuitBreaker(name, logger, threshold, time.Second*time.Duration(cooldownSecs)))
+	}
+	return chain, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// expireCooldown makes the cooldown of the open breaker over without waiting for it.
+func expireCooldown(b *CircuitBreaker) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.openedAt = time.Now().Add(-b.cooldown)
+}
+
+func TestCircuitBreakerOpensAfterThreshold(t *testing.T) {
+	breaker := NewCircuitBreaker("test", newTestLogger(), 3, time.Minute)
+	for i := 0; i < 2; i++ {
+		breaker.Allow()
+		breaker.Failure()
+	}
+	if state := breaker.State(); state != BreakerClosed {
+		t.Fatalf("state after 2 failures is %s, want closed", state)
+	}
+	// A success resets the consecutive failures
+	breaker.Success()
+	for i := 0; i < 2; i++ {
+		breaker.Failure()
+	}
+	if state := breaker.State(); state != BreakerClosed {
+		t.Fatalf("state after a success and 2 failures is %s, want closed", state)
+	}
+	breaker.Failure()
+	if state := breaker.State(); state != BreakerOpen {
+		t.Fatalf("state after 3 failures is %s, want open", state)
+	}
+	if breaker.Allow() {
+		t.Errorf("open breaker allowed a request during the cooldown")
+	}
+}
+
+func TestCircuitBreakerHalfOpenProbe(t *testing.T) {
+	breaker := NewCircuitBreaker("test", newTestLogger(), 1, time.Minute)
+	breaker.Failure()
+	expireCooldown(breaker)
+	// The breaker is reported half-open once the cooldown is over, before any request moves it
+	if state := breaker.State(); state != BreakerHalfOpen {
+		t.Fatalf("state after the cooldown is %s, want half-open", state)
+	}
+	if !breaker.Allow() {
+		t.Fatalf("breaker did not allow the probe after the cooldown")
+	}
+	if breaker.Allow() {
+		t.Errorf("breaker allowed a second request while probing")
+	}
+	// A request released without an answer lets the next probe through
+	breaker.Release()
+	if !breaker.Allow() {
+		t.Fatalf("breaker did not allow a probe after the release")
+	}
+	breaker.Success()
+	if state := breaker.State(); state != BreakerClosed {
+		t.Errorf("state after a successful probe is %s, want closed", state)
+	}
+}
+
+func TestCircuitBreakerFailedProbeReopens(t *testing.T) {
+	breaker := NewCircuitBreaker("test", newTestLogger(), 3, time.Minute)
+	for i := 0; i < 3; i++ {
+		breaker.Failure()
+	}
+	expireCooldown(breaker)
+	if !breaker.Allow() {
+		t.Fatalf("breaker did not allow the probe after the cooldown")
+	}
+	// A single failed probe opens the breaker again, whatever the threshold
+	breaker.Failure()
+	if state := breaker.State(); state != BreakerOpen {
+		t.Errorf("state after a failed probe is %s, want open", state)
+	}
+	if breaker.Allow() {
+		t.Errorf("breaker allowed a request after the failed probe")
+	}
+}
+
+// fakeProvider answers the lookups with its location or error, and counts them.
+type fakeProvider struct {
+	name     string
+	location *GeoLocation
+	err      error
+	calls    int
+}
+
+func (p *fakeProvider) Name() string {
+	return p.name
+}
+
+func (p *fakeProvider) Lookup(ctx context.Context, ip string) (*GeoLocation, error) {
+	p.calls++
+	return p.location, p.err
+}
+
+func newTestProviderChain(t *testing.T, providers ...*fakeProvider) *ProviderChain {
+	t.Helper()
+	byName := map[string]*fakeProvider{}
+	var names []string
+	for _, provider := range providers {
+		byName[provider.name] = provider
+		names = append(names, provider.name)
+	}
+	create := func(name string) (GeoProvider, error) {
+		return byName[name], nil
+	}
+	chain, err := NewProviderChain(names, newTestLogger(), create, nil, 1, nil, 60)
+	if err != nil {
+		t.Fatalf("cannot create the provider chain: %s", err)
+	}
+	return chain
+}
+
+func TestProviderChainFallsBack(t *testing.T) {
+	first := &fakeProvider{name: "first", err: ErrUpstreamUnavailable}
+	second := &fakeProvider{name: "second", location: &GeoLocation{Country: "Canada"}}
+	chain := newTestProviderChain(t, first, second)
+
+	location, err := chain.Lookup(context.Background(), "24.48.0.1")
+	if err != nil || location.Country != "Canada" {
+		t.Fatalf("Lookup returned %v, %v, want the location of the second provider", location, err)
+	}
+	if state := chain.breakers[0].State(); state != BreakerOpen {
+		t.Errorf("breaker of the failed provider is %s, want open", state)
+	}
+	// The open breaker skips the first provider
+	if _, err := chain.Lookup(context.Background(), "24.48.0.1"); err != nil {
+		t.Fatalf("second Lookup failed: %s", err)
+	}
+	if first.calls != 1 || second.calls != 2 {
+		t.Errorf("providers were called %d and %d times, want 1 and 2", first.calls, second.calls)
+	}
+}
+
+func TestProviderChainLocationNotFound(t *testing.T) {
+	first := &fakeProvider{name: "first", err: &LookupFailedError{"private range"}}
+	second := &fakeProvider{name: "second", location: &GeoLocation{Country: "Canada"}}
+	chain := newTestProviderChain(t, first, second)
+
+	// The provider answered, so its breaker stays closed and the next provider is not asked
+	if _, err := chain.Lookup(context.Background(), "10.0.0.1"); !errors.Is(err, ErrLocationNotFound) {
+		t.Errorf("Lookup returned %v, want ErrLocationNotFound", err)
+	}
+	if state := chain.breakers[0].State(); state != BreakerClosed {
+		t.Errorf("breaker of the provider is %s, want closed", state)
+	}
+	if second.calls != 0 {
+		t.Errorf("second provider was called %d times, want 0", second.calls)
+	}
+}
+
+func TestProviderChainRateLimited(t *testing.T) {
+	first := &fakeProvider{name: "first", err: &RetryAfterError{ErrUpstreamRateLimited, time.Minute}}
+	second := &fakeProvider{name: "second", err: ErrUpstreamUnavailable}
+	chain := newTestProviderChain(t, first, second)
+
+	_, err := chain.Lookup(context.Background(), "24.48.0.1")
+	if !errors.Is(err, ErrUpstreamRateLimited) || !errors.Is(err, ErrUpstreamUnavailable) {
+		t.Errorf("Lookup returned %v, want the errors of both providers", err)
+	}
+	// Reaching the rate limit is not a failure of the provider
+	if state := chain.breakers[0].State(); state != BreakerClosed {
+		t.Errorf("breaker of the rate limited provider is %s, want closed", state)
+	}
+}
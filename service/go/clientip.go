@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ClientIPResolver finds the ip of the client which sent a request, looking through the trusted proxies in front of the service.
+// The forwarding headers are only read when the request comes from a trusted proxy, otherwise anyone could spoof them.
+type ClientIPResolver struct {
+	trusted []*net.IPNet
+}
+
+func (res *ClientIPResolver) isTrusted(ip net.IP) bool {
+	for _, network := range res.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the ip of the client. If the request comes from a trusted proxy, the forwarding chain of the Forwarded
+// header, or the X-Forwarded-For header if there is none, is walked from right to left skipping the trusted hops, and
+// the first untrusted hop is the client. X-Real-IP is used when there is no chain, and the address of the peer is used
+// when none of the headers is usable.
+func (res *ClientIPResolver) ClientIP(r *http.Request) string {
+	remoteIp := parseHostIp(r.RemoteAddr)
+	if remoteIp == nil || !res.isTrusted(remoteIp) {
+		if remoteIp == nil {
+			return r.RemoteAddr
+		}
+		return remoteIp.String()
+	}
+
+	chain := forwardedChain(r.Header.Values("Forwarded"))
+	if len(chain) == 0 {
+		chain = forwardedForChain(r.Header.Values("X-Forwarded-For"))
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		hop := chain[i]
+		if hop == nil {
+			// An unknown or obfuscated hop, the hops before it cannot be trusted
+			break
+		}
+		if !res.isTrusted(hop) || i == 0 {
+			return hop.String()
+		}
+	}
+
+	if realIp := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); realIp != nil {
+		return realIp.String()
+	}
+	return remoteIp.String()
+}
+
+// parseHostIp parses an ip which may have a port, in the forms of 1.2.3.4, 1.2.3.4:80, 2001:db8::1 or [2001:db8::1]:80.
+func parseHostIp(hostPort string) net.IP {
+	hostPort = strings.TrimSpace(hostPort)
+	if ip := net.ParseIP(strings.Trim(hostPort, "[]")); ip != nil {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// forwardedForChain returns the hops of the X-Forwarded-For headers, nil hops are the ones which are not ips.
+func forwardedForChain(values []string) []net.IP {
+	var chain []net.IP
+	for _, value := range values {
+		for _, hop := range strings.Split(value, ",") {
+			chain = append(chain, parseHostIp(hop))
+		}
+	}
+	return chain
+}
+
+// forwardedChain returns the for= hops of the RFC 7239 Forwarded headers, e.g. for=192.0.2.60;proto=http, for="[2001:db8::17]:4711".
+// Nil hops are the unknown or obfuscated ones.
+func forwardedChain(values []string) []net.IP {
+	var chain []net.IP
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, hop, found := strings.Cut(strings.TrimSpace(pair), "=")
+				if found && strings.EqualFold(key, "for") {
+					chain = append(chain, parseHostIp(strings.Trim(hop, `"`)))
+				}
+			}
+		}
+	}
+	return chain
+}
+
+// NewClientIPResolver creates a resolver trusting the given proxies, each one a cidr such as 10.42.0.0/16 or a single ip.
+func NewClientIPResolver(trustedProxies []string) (*ClientIPResolver, error) {
+	resolver := &ClientIPResolver{}
+	for _, proxy := range trustedProxies {
+		proxy = strings.TrimSpace(proxy)
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("bad trusted proxy %q, expected a cidr or an ip", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				bits = 8 * net.IPv4len
+			}
+			proxy = fmt.Sprintf("%s/%d", proxy, bits)
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("bad trusted proxy %q: %w", proxy, err)
+		}
+		resolver.trusted = append(resolver.trusted, network)
+	}
+	return resolver, nil
+}
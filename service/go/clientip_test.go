@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	resolver, err := NewClientIPResolver([]string{"10.0.0.0/8", " 192.0.2.1"})
+	if err != nil {
+		t.Fatalf("cannot create the resolver: %s", err)
+	}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     http.Header
+		want       string
+	}{
+		{
+			name:       "untrusted peer cannot spoof the headers",
+			remoteAddr: "203.0.113.5:1234",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.7"}, "X-Real-Ip": {"198.51.100.8"}},
+			want:       "203.0.113.5",
+		},
+		{
+			name:       "untrusted ipv6 peer",
+			remoteAddr: "[2001:db8::1]:443",
+			want:       "2001:db8::1",
+		},
+		{
+			name:       "trusted peer without headers",
+			remoteAddr: "10.0.0.1:1234",
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "x-forwarded-for through a trusted proxy",
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.7, 10.0.0.2"}},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "spoofed hops left of the client are ignored",
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"X-Forwarded-For": {"1.2.3.4, 198.51.100.7, 10.0.0.2"}},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "x-forwarded-for split over several headers",
+			remoteAddr: "192.0.2.1:1234",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.7", "10.0.0.2"}},
+			want:       "198.51.100.7",
+		},
+		{
+			name:       "all hops trusted gives the leftmost one",
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}},
+			want:       "10.0.0.3",
+		},
+		{
+			name:       "forwarded is used over x-forwarded-for",
+			remoteAddr: "10.0.0.1:1234",
+			header: http.Header{
+				"Forwarded":       {`for="[2001:db8::17]:4711";proto=https, for=10.0.0.2`},
+				"X-Forwarded-For": {"198.51.100.7"},
+			},
+			want: "2001:db8::17",
+		},
+		{
+			name:       "unknown hop falls back to x-real-ip",
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"Forwarded": {"for=198.51.100.7, for=unknown"}, "X-Real-Ip": {"198.51.100.9"}},
+			want:       "198.51.100.9",
+		},
+		{
+			name:       "bad hop falls back to the peer",
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"X-Forwarded-For": {"198.51.100.7, not-an-ip"}},
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "x-real-ip through a trusted proxy",
+			remoteAddr: "10.0.0.1:1234",
+			header:     http.Header{"X-Real-Ip": {"198.51.100.9"}},
+			want:       "198.51.100.9",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/ip/me", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for name, values := range tt.header {
+				r.Header[name] = values
+			}
+			if got := resolver.ClientIP(r); got != tt.want {
+				t.Errorf("ClientIP returned %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewClientIPResolverBadProxy(t *testing.T) {
+	for _, proxy := range []string{"10.0.0.0/33", "proxy.local"} {
+		if _, err := NewClientIPResolver([]string{proxy}); err == nil {
+			t.Errorf("NewClientIPResolver accepted the trusted proxy %q", proxy)
+		}
+	}
+}
@@ -4,14 +4,31 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"net/http"
+	"regexp"
 	"time"
 
 	_ "github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
 	envconfig "github.com/sethvargo/go-envconfig"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 )
 
 // AppConfig is the api config, and is configurable via environment variables.
 type AppConfig struct {
+	// Logging Config, the format is either json or text, and the level one of the logrus levels e.g. debug or info
+	LogLevel  string `env:"LOG_LEVEL, default=info"`
+	LogFormat string `env:"LOG_FORMAT, default=json"`
+	// Tracing Config, the spans are exported over OTLP/HTTP to TRACING_OTLP_ENDPOINT, e.g. tempo:4318, and are not
+	// exported if it is empty. TRACING_SAMPLE_RATIO of the new traces are sampled, the sampling of the callers is followed.
+	TracingOTLPEndpoint string  `env:"TRACING_OTLP_ENDPOINT"`
+	TracingOTLPInsecure bool    `env:"TRACING_OTLP_INSECURE, default=true"`
+	TracingServiceName  string  `env:"TRACING_SERVICE_NAME, default=geolocation-service"`
+	TracingSampleRatio  float64 `env:"TRACING_SAMPLE_RATIO, default=1"`
 	// DB Config
 	DBHost         string `env:"DB_HOST, default=localhost"`
 	DBPort         int    `env:"DB_PORT, default=5432"`
@@ -23,8 +40,111 @@ type AppConfig struct {
 	DBMaxIdleConns int    `env:"DB_MAX_IDLE_CONNS, default=512"`
 	DBMaxLifeTime  int    `env:"DB_MAX_LIFETIME_SECS, default=20"`
 	DBMaxIdleTime  int    `env:"DB_MAX_IDLETIME_SECS, default=10"`
+	// Apply the embedded migrations on startup, they can also be applied with the migrate subcommand
+	DBMigrateOnStartup bool `env:"DB_MIGRATE_ON_STARTUP, default=true"`
+	// Cache Config, stale items are served for CACHE_STALE_SECS after expiry while being refreshed in the background
+	CacheTTLSecs   int `env:"CACHE_TTL_SECS, default=604800"`
+	CacheStaleSecs int `env:"CACHE_STALE_SECS, default=86400"`
+	// TTL of the negative items cached for the ips the provider has no location for, e.g. private or reserved ranges
+	CacheNegativeTTLSecs int `env:"CACHE_NEGATIVE_TTL_SECS, default=3600"`
+	// Shared cache backend, either postgres (the DB_TABLE_NAME table) or redis
+	CacheBackend  string `env:"CACHE_BACKEND, default=postgres"`
+	RedisAddr     string `env:"REDIS_ADDR, default=localhost:6379"`
+	RedisPassword string `env:"REDIS_PASSWORD"`
+	RedisDB       int    `env:"REDIS_DB, default=0"`
+	// In-memory LRU cache tier in front of the database, a size of 0 disables it
+	CacheLRUSize    int `env:"CACHE_LRU_SIZE, default=10000"`
+	CacheLRUTTLSecs int `env:"CACHE_LRU_TTL_SECS, default=300"`
+	// Timeouts of the stages of a lookup, the upstream one is for the lookup through all of the providers, 0 disables them
+	CacheReadTimeoutMs  int `env:"CACHE_READ_TIMEOUT_MS, default=500"`
+	CacheWriteTimeoutMs int `env:"CACHE_WRITE_TIMEOUT_MS, default=1000"`
+	GeoLookupTimeoutMs  int `env:"GEO_LOOKUP_TIMEOUT_MS, default=5000"`
+	// Write-behind queue of the fetched items, CACHE_WRITE_WORKERS workers write batches of up to CACHE_WRITE_BATCH_SIZE
+	// items, or whatever is queued every CACHE_WRITE_FLUSH_MS, and the items are dropped when the queue is full
+	CacheWriteQueueSize int `env:"CACHE_WRITE_QUEUE_SIZE, default=10000"`
+	CacheWriteWorkers   int `env:"CACHE_WRITE_WORKERS, default=2"`
+	CacheWriteBatchSize int `env:"CACHE_WRITE_BATCH_SIZE, default=100"`
+	CacheWriteFlushMs   int `env:"CACHE_WRITE_FLUSH_MS, default=200"`
 	// Server Port
 	ServerPort int `env:"SERVER_PORT, default=3333"`
+	// Port of the admin listener serving the metrics, pprof, probes and admin routes, apart from the public api
+	AdminPort int `env:"ADMIN_PORT, default=8081"`
+	// On SIGTERM the service is not ready anymore but keeps serving for SERVER_DRAIN_SECS, so it is removed from the
+	// endpoints first, and then waits up to SERVER_SHUTDOWN_TIMEOUT_SECS for the requests in flight to finish
+	ServerDrainSecs           int `env:"SERVER_DRAIN_SECS, default=5"`
+	ServerShutdownTimeoutSecs int `env:"SERVER_SHUTDOWN_TIMEOUT_SECS, default=20"`
+	// Timeout of the database ping of the readiness check
+	ReadinessTimeoutMs int `env:"READINESS_TIMEOUT_MS, default=1000"`
+	// Proxies in front of the service whose forwarding headers are trusted, as cidrs or ips, e.g. 10.42.0.0/16,10.0.0.1
+	TrustedProxies []string `env:"TRUSTED_PROXIES"`
+	// Batch lookup config, the misses of a batch are fetched from web with at most BATCH_CONCURRENCY lookups at a time
+	BatchMaxIps      int `env:"BATCH_MAX_IPS, default=1000"`
+	BatchConcurrency int `env:"BATCH_CONCURRENCY, default=16"`
+	// Geolocation Provider Config
+	GeoProviders           []string `env:"GEO_PROVIDERS, default=ip-api"`
+	GeoProviderToken       string   `env:"GEO_PROVIDER_TOKEN"`
+	GeoProviderURLTemplate string   `env:"GEO_PROVIDER_URL_TEMPLATE"`
+	GeoProviderJSONPath    string   `env:"GEO_PROVIDER_JSON_PATH"`
+	// Paths of the other location fields for the json provider, in the form of country_code:data.iso,city:data.city
+	GeoProviderJSONFieldPaths map[string]string `env:"GEO_PROVIDER_JSON_FIELD_PATHS"`
+	GeoMMDBPath               string            `env:"GEO_MMDB_PATH"`
+	GeoMMDBReloadSecs         int               `env:"GEO_MMDB_RELOAD_SECS, default=60"`
+	// Requests per minute allowed by ip-api.com, 0 disables the client side rate limit e.g. for the pro tier.
+	// A lookup waits up to GEO_RATE_LIMIT_MAX_WAIT_SECS for the budget to refill before it fails.
+	GeoIpApiRateLimit       int `env:"GEO_IP_API_RATE_LIMIT, default=45"`
+	GeoRateLimitMaxWaitSecs int `env:"GEO_RATE_LIMIT_MAX_WAIT_SECS, default=1"`
+	// Circuit breaker config, the per provider maps are in the form of ip-api:5,ipinfo:3
+	GeoBreakerFailureThreshold  int            `env:"GEO_BREAKER_FAILURE_THRESHOLD, default=5"`
+	GeoBreakerFailureThresholds map[string]int `env:"GEO_BREAKER_FAILURE_THRESHOLDS"`
+	GeoBreakerCooldownSecs      int            `env:"GEO_BREAKER_COOLDOWN_SECS, default=30"`
+	GeoBreakerCooldownsSecs     map[string]int `env:"GEO_BREAKER_COOLDOWNS_SECS"`
+}
+
+// ConfigureLogger sets the level and format of the logger from the AppConfig struct.
+func (config *AppConfig) ConfigureLogger(logger *logrus.Logger) error {
+	level, err := logrus.ParseLevel(config.LogLevel)
+	if err != nil {
+		return fmt.Errorf("LOG_LEVEL is not a valid level: %w", err)
+	}
+	logger.SetLevel(level)
+	switch config.LogFormat {
+	case "json":
+		logger.SetFormatter(&logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano})
+	case "text":
+		logger.SetFormatter(&logrus.TextFormatter{FullTimestamp: true, TimestampFormat: time.RFC3339Nano})
+	default:
+		return fmt.Errorf("LOG_FORMAT must be json or text, got: %q", config.LogFormat)
+	}
+	return nil
+}
+
+// CreateTracerProvider creates the tracer provider exporting the spans as configured by the AppConfig struct,
+// it must be shut down to flush the spans which are not exported yet.
+func (config *AppConfig) CreateTracerProvider(ctx context.Context) (*sdktrace.TracerProvider, error) {
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(config.TracingServiceName),
+	))
+	if err != nil {
+		return nil, err
+	}
+	// Without an exporter nothing is sampled, so the logs and exemplars do not point to traces which are never exported
+	if config.TracingOTLPEndpoint == "" {
+		return sdktrace.NewTracerProvider(sdktrace.WithResource(res), sdktrace.WithSampler(sdktrace.NeverSample())), nil
+	}
+	exporterOptions := []otlptracehttp.Option{otlptracehttp.WithEndpoint(config.TracingOTLPEndpoint)}
+	if config.TracingOTLPInsecure {
+		exporterOptions = append(exporterOptions, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, exporterOptions...)
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.TracingSampleRatio))),
+		sdktrace.WithBatcher(exporter),
+	), nil
 }
 
 // CreateDBConnection establishes and returns a new database connection using the AppConfig struct.
@@ -50,11 +170,70 @@ func (config *AppConfig) CreateDBConnection() (*sql.DB, error) {
 	return db, nil
 }
 
+// CreateCacheStore creates the cache store selected by the AppConfig struct.
+func (config *AppConfig) CreateCacheStore(db *sql.DB, logger *logrus.Logger) (CacheStore, error) {
+	ttl := time.Second * time.Duration(config.CacheTTLSecs)
+	negativeTTL := time.Second * time.Duration(config.CacheNegativeTTLSecs)
+	switch config.CacheBackend {
+	case "postgres":
+		return NewPostgresCacheStore(db, logger, config.DBTableName, ttl, negativeTTL), nil
+	case "redis":
+		client := redis.NewClient(&redis.Options{
+			Addr:     config.RedisAddr,
+			Password: config.RedisPassword,
+			DB:       config.RedisDB,
+		})
+		if err := client.Ping(context.Background()).Err(); err != nil {
+			client.Close()
+			return nil, err
+		}
+		return NewRedisCacheStore(client, logger, config.DBTableName, ttl, negativeTTL, time.Second*time.Duration(config.CacheStaleSecs)), nil
+	default:
+		return nil, fmt.Errorf("unknown cache backend: %q", config.CacheBackend)
+	}
+}
+
+// CreateWriteBehindQueue creates the write-behind queue of the cache store configured by the AppConfig struct.
+func (config *AppConfig) CreateWriteBehindQueue(cache CacheStore, logger *logrus.Logger) *WriteBehindQueue {
+	return NewWriteBehindQueue(
+		cache, logger,
+		config.CacheWriteQueueSize, config.CacheWriteWorkers, config.CacheWriteBatchSize,
+		time.Millisecond*time.Duration(config.CacheWriteFlushMs), time.Millisecond*time.Duration(config.CacheWriteTimeoutMs),
+	)
+}
+
+// CreateClientIPResolver creates the client ip resolver trusting the proxies of the AppConfig struct.
+func (config *AppConfig) CreateClientIPResolver() (*ClientIPResolver, error) {
+	return NewClientIPResolver(config.TrustedProxies)
+}
+
+// CreateGeoProvider creates the chain of geolocation providers selected by the AppConfig struct.
+func (config *AppConfig) CreateGeoProvider(client *http.Client, logger *logrus.Logger) (GeoProvider, error) {
+	create := func(name string) (GeoProvider, error) {
+		return NewGeoProvider(name, client, logger, config)
+	}
+	return NewProviderChain(
+		config.GeoProviders, logger, create,
+		config.GeoBreakerFailureThresholds, config.GeoBreakerFailureThreshold,
+		config.GeoBreakerCooldownsSecs, config.GeoBreakerCooldownSecs,
+	)
+}
+
+// sqlIdentifier matches the unquoted PostgreSQL identifiers, which are at most 63 characters long.
+var sqlIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,62}$`)
+
 // NewAppConfig is the constructor for AppConfig which reads config from environment variables.
 func NewAppConfig() (*AppConfig, error) {
 	//// Init database connection
 	ctx := context.Background()
 	var config AppConfig
 	err := envconfig.Process(ctx, &config)
-	return &config, err
+	if err != nil {
+		return &config, err
+	}
+	// The table name is interpolated into the queries, so it must be a plain identifier
+	if !sqlIdentifier.MatchString(config.DBTableName) {
+		return &config, fmt.Errorf("DB_TABLE_NAME must be a valid sql identifier, got: %q", config.DBTableName)
+	}
+	return &config, nil
 }
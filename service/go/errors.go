@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// Sentinel errors of the lookups, they are wrapped with the details and mapped to the api errors by apiErrorMappings.
+var (
+	ErrInvalidIp        = errors.New("bad ip address")
+	ErrInvalidRequest   = errors.New("invalid request")
+	ErrRouteNotFound    = errors.New("not found")
+	ErrMethodNotAllowed = errors.New("method not allowed")
+	// ErrLocationNotFound is matched by every LookupFailedError.
+	ErrLocationNotFound = errors.New("no location found")
+	// ErrCacheMiss is returned by the cache stores for the ips which are not cached, it is not an api error.
+	ErrCacheMiss           = errors.New("ip is not cached")
+	ErrCacheUnavailable    = errors.New("cache is unavailable")
+	ErrUpstreamUnavailable = errors.New("geolocation provider is unavailable")
+	ErrUpstreamRateLimited = errors.New("geolocation provider rate limit is reached")
+)
+
+// withContextError adds the error of the context to err if the context is done, so the cancellations and timeouts
+// can be told apart from the other errors, as the drivers do not always wrap it.
+func withContextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil && !errors.Is(err, ctxErr) {
+		return fmt.Errorf("%w: %w", err, ctxErr)
+	}
+	return err
+}
+
+// RetryAfterError is an error after which the request can be retried, the delay is returned as retry_after.
+type RetryAfterError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", e.Err, e.RetryAfter)
+}
+
+func (e *RetryAfterError) Unwrap() error {
+	return e.Err
+}
+
+// apiErrorMapping is how an error is returned to the caller and counted in the webservice errors metric.
+type apiErrorMapping struct {
+	err    error
+	code   string
+	status int
+	// label is the error label of the webservice errors metric, the client errors have none and are not counted
+	label string
+	// message replaces the error message in the response, so the internals of the server errors are not returned
+	message string
+}
+
+// apiErrorMappings are matched in order with errors.Is, the errors which match none of them are internal errors.
+var apiErrorMappings = []apiErrorMapping{
+	// The cancellations and timeouts come first, so they are counted apart from the errors of the stage they ended
+	{context.Canceled, "REQUEST_CANCELED", 499, "canceled", "request canceled"},
+	{context.DeadlineExceeded, "TIMEOUT", http.StatusGatewayTimeout, "timeout", "request timed out"},
+	{ErrInvalidIp, "INVALID_IP", http.StatusBadRequest, "", ""},
+	{ErrInvalidRequest, "INVALID_REQUEST", http.StatusBadRequest, "", ""},
+	{ErrRouteNotFound, "NOT_FOUND", http.StatusNotFound, "", ""},
+	{ErrMethodNotAllowed, "METHOD_NOT_ALLOWED", http.StatusMethodNotAllowed, "", ""},
+	{ErrLocationNotFound, "LOCATION_NOT_FOUND", http.StatusNotFound, "", ""},
+	{ErrUpstreamRateLimited, "UPSTREAM_RATE_LIMITED", http.StatusServiceUnavailable, "web_rate_limited", "geolocation provider rate limit is reached"},
+	{ErrUpstreamUnavailable, "UPSTREAM_UNAVAILABLE", http.StatusBadGateway, "web_fetch_error", "geolocation provider is unavailable"},
+	{ErrCacheUnavailable, "CACHE_UNAVAILABLE", http.StatusServiceUnavailable, "cache_error", "cache is unavailable"},
+}
+
+var internalErrorMapping = apiErrorMapping{nil, "INTERNAL_ERROR", http.StatusInternalServerError, "internal_error", "internal error"}
+
+func mapApiError(err error) apiErrorMapping {
+	for _, mapping := range apiErrorMappings {
+		if errors.Is(err, mapping.err) {
+			return mapping
+		}
+	}
+	return internalErrorMapping
+}
+
+// responseMessage is the message of the error returned to the caller.
+func (mapping apiErrorMapping) responseMessage(err error) string {
+	if mapping.message != "" {
+		return mapping.message
+	}
+	return err.Error()
+}
+
+// countError counts the server errors in the webservice errors metric under the label of their mapping.
+func countError(path string, err error) {
+	if label := mapApiError(err).label; label != "" {
+		webserviceErrors.WithLabelValues(path, label).Inc()
+	}
+}
+
+// writeApiError writes the error with the code and status of its mapping and the id of the request.
+// The Retry-After header and retry_after are set if the error is a RetryAfterError.
+func writeApiError(w http.ResponseWriter, r *http.Request, err error) {
+	mapping := mapApiError(err)
+	countError(routePattern(r), err)
+	body := ApiErrorResponseData{
+		Code:      mapping.code,
+		Message:   mapping.responseMessage(err),
+		RequestID: requestID(r),
+	}
+	var retryAfter *RetryAfterError
+	if errors.As(err, &retryAfter) {
+		body.RetryAfter = int(math.Ceil(retryAfter.RetryAfter.Seconds()))
+		w.Header().Set("Retry-After", fmt.Sprint(body.RetryAfter))
+	}
+	message, _ := json.Marshal(body)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(mapping.status)
+	w.Write(message)
+}
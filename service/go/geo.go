@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/text/language"
+	"golang.org/x/text/language/display"
+)
+
+// GeoLocation is the geolocation of an ip, the json field names are the ones accepted by the fields query parameter.
+type GeoLocation struct {
+	Country     string  `json:"country"`
+	CountryCode string  `json:"country_code"`
+	Region      string  `json:"region"`
+	City        string  `json:"city"`
+	Lat         float64 `json:"lat"`
+	Lon         float64 `json:"lon"`
+	Timezone    string  `json:"timezone"`
+	ISP         string  `json:"isp"`
+	Org         string  `json:"org"`
+	// ASN is the autonomous system number in the form of AS15169
+	ASN string `json:"asn"`
+}
+
+// GeoProvider resolves the geolocation of an ip address using an external geolocation service.
+type GeoProvider interface {
+	// Name is the identifier of the provider, used in logs and configuration.
+	Name() string
+	// Lookup returns the geolocation of the given ip, providers fill in as many of the fields as they know.
+	// The lookup is abandoned when the context is done.
+	Lookup(ctx context.Context, ip string) (*GeoLocation, error)
+}
+
+// LookupFailedError is returned when the provider answered that it has no location for the ip, e.g. because
+// the ip is in a private or reserved range. Unlike the other errors it is an answer, and is cached as such.
+type LookupFailedError struct {
+	Reason string
+}
+
+func (e *LookupFailedError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrLocationNotFound, e.Reason)
+}
+
+func (e *LookupFailedError) Is(target error) bool {
+	return target == ErrLocationNotFound
+}
+
+// fetchJSON sends a GET request to the given url and unmarshals the json response body into out.
+func fetchJSON(ctx context.Context, client *http.Client, logger *logrus.Logger, requestUrl string, out interface{}) error {
+	_, err := fetchJSONWithHeaders(ctx, client, logger, requestUrl, out)
+	return err
+}
+
+// fetchJSONWithHeaders is fetchJSON which also returns the response headers, whether the request failed or not.
+// The headers are nil if no response was received.
+func fetchJSONWithHeaders(ctx context.Context, client *http.Client, logger *logrus.Logger, requestUrl string, out interface{}) (header http.Header, err error) {
+	log := ctxLogger(ctx, logger)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	// The query is left out of the span as it may have the token of the provider
+	ctx, span := tracer.Start(ctx, http.MethodGet,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.HTTPRequestMethodGet, semconv.ServerAddress(req.URL.Hostname()), semconv.URLPath(req.URL.Path)),
+	)
+	defer func() { endSpan(span, err) }()
+	req = req.WithContext(ctx)
+	injectTraceContext(req)
+	res, err := client.Do(req)
+	// Check if request was made ok
+	if err != nil {
+		log.Warnf("Error when getting ip from: %s: %s", requestUrl, err)
+		return nil, err
+	}
+	// Close the body buffer
+	defer res.Body.Close()
+	span.SetAttributes(semconv.HTTPResponseStatusCode(res.StatusCode))
+	// The provider tells when its rate limit resets in the Retry-After header, if at all
+	if res.StatusCode == http.StatusTooManyRequests {
+		log.Warnf("IP service rate limit is reached, status code received: %d", res.StatusCode)
+		if secs, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+			return res.Header, &RetryAfterError{ErrUpstreamRateLimited, time.Second * time.Duration(secs)}
+		}
+		return res.Header, ErrUpstreamRateLimited
+	}
+	// Check status code if not return error
+	if res.StatusCode != http.StatusOK {
+		log.Errorf("IP service is not responding in expected way, status code received: %d", res.StatusCode)
+		return res.Header, fmt.Errorf("Bad status code error")
+	}
+	// Read the buffer and create the response type
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		log.Errorf("Cannot read the response body.")
+		return res.Header, fmt.Errorf("Response body unreadable error")
+	}
+	err = json.Unmarshal(body, out)
+	if err != nil {
+		log.Errorf("Cannot unmarshall the response json to the %T type.", out)
+		return res.Header, err
+	}
+	return res.Header, nil
+}
+
+// splitAS splits an autonomous system description such as "AS15169 Google LLC" into the number and the name.
+func splitAS(as string) (string, string) {
+	number, name, _ := strings.Cut(strings.TrimSpace(as), " ")
+	if !strings.HasPrefix(number, "AS") {
+		return "", strings.TrimSpace(as)
+	}
+	return number, name
+}
+
+// IpApiResponseBody is the response of http://ip-api.com/json.
+type IpApiResponseBody struct {
+	Query       string
+	Status      string
+	Message     string
+	Country     string
+	CountryCode string
+	RegionName  string
+	City        string
+	Lat         float64
+	Lon         float64
+	Timezone    string
+	Isp         string
+	Org         string
+	As          string
+}
+
+// IpApiProvider looks up ips using http://ip-api.com.
+// The free tier allows 45 requests a minute, the lookups are held back by the budget when it is used up.
+type IpApiProvider struct {
+	client  *http.Client
+	logger  *logrus.Logger
+	baseUrl string
+	// budget follows the X-Rl and X-Ttl headers of the responses, it is nil if the requests are not limited
+	budget *RateBudget
+}
+
+func (p *IpApiProvider) Name() string {
+	return "ip-api"
+}
+
+func (p *IpApiProvider) Lookup(ctx context.Context, ip string) (*GeoLocation, error) {
+	// sample request: http://ip-api.com/json/24.48.0.1
+	if p.budget != nil {
+		if err := p.budget.Take(ctx); err != nil {
+			return nil, err
+		}
+	}
+	var data IpApiResponseBody
+	header, err := fetchJSONWithHeaders(ctx, p.client, p.logger, fmt.Sprintf("%s/json/%s", p.baseUrl, ip), &data)
+	if p.budget != nil && header != nil {
+		// X-Rl is the number of requests left in the window, and X-Ttl the seconds until the window resets
+		p.budget.Update(header, "X-Rl", "X-Ttl")
+		if errors.Is(err, ErrUpstreamRateLimited) {
+			secs, _ := strconv.Atoi(header.Get("X-Ttl"))
+			retryAfter := time.Second * time.Duration(max(secs, 1))
+			p.budget.Exhaust(time.Now().Add(retryAfter))
+			return nil, &RetryAfterError{ErrUpstreamRateLimited, retryAfter}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Unroutable and invalid ips are answered with a fail status and the reason in the message
+	if data.Status == "fail" {
+		return nil, &LookupFailedError{data.Message}
+	}
+	asn, _ := splitAS(data.As)
+	return &GeoLocation{
+		Country:     data.Country,
+		CountryCode: data.CountryCode,
+		Region:      data.RegionName,
+		City:        data.City,
+		Lat:         data.Lat,
+		Lon:         data.Lon,
+		Timezone:    data.Timezone,
+		ISP:         data.Isp,
+		Org:         data.Org,
+		ASN:         asn,
+	}, nil
+}
+
+// countryName returns the english name of an ISO 3166 country code, e.g. "United States" for "US".
+func countryName(code string) (string, error) {
+	region, err := language.ParseRegion(code)
+	if err != nil || !region.IsCountry() {
+		return "", fmt.Errorf("Unknown country code error")
+	}
+	name := display.English.Regions().Name(region)
+	if name == "" {
+		return "", fmt.Errorf("Unknown country code error")
+	}
+	return name, nil
+}
+
+// IpInfoResponseBody is the subset of the https://ipinfo.io response used by the app.
+type IpInfoResponseBody struct {
+	Ip       string `json:"ip"`
+	Country  string `json:"country"`
+	Region   string `json:"region"`
+	City     string `json:"city"`
+	Loc      string `json:"loc"`
+	Org      string `json:"org"`
+	Timezone string `json:"timezone"`
+}
+
+// IpInfoProvider looks up ips using https://ipinfo.io, the token is optional for the free tier.
+type IpInfoProvider struct {
+	client  *http.Client
+	logger  *logrus.Logger
+	baseUrl string
+	token   string
+}
+
+func (p *IpInfoProvider) Name() string {
+	return "ipinfo"
+}
+
+func (p *IpInfoProvider) Lookup(ctx context.Context, ip string) (*GeoLocation, error) {
+	// sample request: https://ipinfo.io/24.48.0.1/json?token=xxxx
+	requestUrl := fmt.Sprintf("%s/%s/json", p.baseUrl, ip)
+	if p.token != "" {
+		requestUrl += "?token=" + url.QueryEscape(p.token)
+	}
+	var data IpInfoResponseBody
+	if err := fetchJSON(ctx, p.client, p.logger, requestUrl, &data); err != nil {
+		return nil, err
+	}
+	// ipinfo only returns the country code, an answer without a known code is a failure so the next provider is tried
+	country, err := countryName(data.Country)
+	if err != nil {
+		ctxLogger(ctx, p.logger).Warnf("ipinfo answered ip %s with the country code %q: %s", ip, data.Country, err)
+		return nil, err
+	}
+	location := &GeoLocation{
+		Country:     country,
+		CountryCode: data.Country,
+		Region:      data.Region,
+		City:        data.City,
+		Timezone:    data.Timezone,
+	}
+	// loc is in the form of "37.4056,-122.0775"
+	if lat, lon, found := strings.Cut(data.Loc, ","); found {
+		location.Lat, _ = strconv.ParseFloat(lat, 64)
+		location.Lon, _ = strconv.ParseFloat(lon, 64)
+	}
+	// org is in the form of "AS15169 Google LLC"
+	location.ASN, location.Org = splitAS(data.Org)
+	location.ISP = location.Org
+	return location, nil
+}
+
+// IpApiCoResponseBody is the subset of the https://ipapi.co response used by the app.
+type IpApiCoResponseBody struct {
+	Ip          string  `json:"ip"`
+	CountryName string  `json:"country_name"`
+	CountryCode string  `json:"country_code"`
+	Region      string  `json:"region"`
+	City        string  `json:"city"`
+	Latitude    float64 `json:"latitude"`
+	Longitude   float64 `json:"longitude"`
+	Timezone    string  `json:"timezone"`
+	Org         string  `json:"org"`
+	Asn         string  `json:"asn"`
+	Error       bool    `json:"error"`
+	Reason      string  `json:"reason"`
+}
+
+// IpApiCoProvider looks up ips using https://ipapi.co.
+type IpApiCoProvider struct {
+	client  *http.Client
+	logger  *logrus.Logger
+	baseUrl string
+}
+
+func (p *IpApiCoProvider) Name() string {
+	return "ipapi.co"
+}
+
+func (p *IpApiCoProvider) Lookup(ctx context.Context, ip string) (*GeoLocation, error) {
+	// sample request: https://ipapi.co/24.48.0.1/json/
+	var data IpApiCoResponseBody
+	if err := fetchJSON(ctx, p.client, p.logger, fmt.Sprintf("%s/%s/json/", p.baseUrl, ip), &data); err != nil {
+		return nil, err
+	}
+	// ipapi.co answers with error set for the ips it has no location for, e.g. reserved ips
+	if data.Error {
+		return nil, &LookupFailedError{data.Reason}
+	}
+	return &GeoLocation{
+		Country:     data.CountryName,
+		CountryCode: data.CountryCode,
+		Region:      data.Region,
+		City:        data.City,
+		Lat:         data.Latitude,
+		Lon:         data.Longitude,
+		Timezone:    data.Timezone,
+		ISP:         data.Org,
+		Org:         data.Org,
+		ASN:         data.Asn,
+	}, nil
+}
+
+// JSONProvider looks up ips using any service returning json, configured by a url template and json paths.
+// The url template must contain an {ip} placeholder, e.g. https://example.com/geo/{ip}, and a json path is
+// a dot separated list of keys leading to a field, e.g. data.location.country. The country path is required,
+// and the paths of the other GeoLocation fields are optional.
+type JSONProvider struct {
+	client      *http.Client
+	logger      *logrus.Logger
+	urlTemplate string
+	// fieldPaths maps the json field names of GeoLocation to their paths in the response
+	fieldPaths map[string][]string
+}
+
+func (p *JSONProvider) Name() string {
+	return "json"
+}
+
+func (p *JSONProvider) Lookup(ctx context.Context, ip string) (*GeoLocation, error) {
+	requestUrl := strings.ReplaceAll(p.urlTemplate, "{ip}", url.PathEscape(ip))
+	var data interface{}
+	if err := fetchJSON(ctx, p.client, p.logger, requestUrl, &data); err != nil {
+		return nil, err
+	}
+	fields := map[string]interface{}{}
+	for field, path := range p.fieldPaths {
+		value := data
+		for _, key := range path {
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("json path %s: %s is not an object", strings.Join(path, "."), key)
+			}
+			value = object[key]
+		}
+		fields[field] = value
+	}
+	if _, ok := fields["country"].(string); !ok {
+		return nil, fmt.Errorf("json path %s does not point to a string", strings.Join(p.fieldPaths["country"], "."))
+	}
+	// The collected fields are decoded into the location through its json field names
+	raw, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	var location GeoLocation
+	if err := json.Unmarshal(raw, &location); err != nil {
+		return nil, fmt.Errorf("json provider fields have unexpected types: %w", err)
+	}
+	return &location, nil
+}
+
+// NewGeoProvider creates the provider registered under the given name.
+func NewGeoProvider(name string, client *http.Client, logger *logrus.Logger, config *AppConfig) (GeoProvider, error) {
+	client = instrumentClient(client, name)
+	switch name {
+	case "ip-api":
+		budget := NewRateBudget(name, config.GeoIpApiRateLimit, time.Minute, time.Second*time.Duration(config.GeoRateLimitMaxWaitSecs))
+		return &IpApiProvider{client, logger, "http://ip-api.com", budget}, nil
+	case "ipinfo":
+		return &IpInfoProvider{client, logger, "https://ipinfo.io", config.GeoProviderToken}, nil
+	case "ipapi.co":
+		return &IpApiCoProvider{client, logger, "https://ipapi.co"}, nil
+	case "json":
+		if !strings.Contains(config.GeoProviderURLTemplate, "{ip}") {
+			return nil, fmt.Errorf("GEO_PROVIDER_URL_TEMPLATE must contain an {ip} placeholder, got: %q", config.GeoProviderURLTemplate)
+		}
+		if config.GeoProviderJSONPath == "" {
+			return nil, fmt.Errorf("GEO_PROVIDER_JSON_PATH must be set for the json provider")
+		}
+		fieldPaths := map[string][]string{"country": strings.Split(config.GeoProviderJSONPath, ".")}
+		for field, path := range config.GeoProviderJSONFieldPaths {
+			if !isGeoLocationField(field) {
+				return nil, fmt.Errorf("GEO_PROVIDER_JSON_FIELD_PATHS has an unknown field: %q", field)
+			}
+			fieldPaths[field] = strings.Split(path, ".")
+		}
+		return &JSONProvider{client, logger, config.GeoProviderURLTemplate, fieldPaths}, nil
+	case "mmdb":
+		return NewMMDBProvider(config.GeoMMDBPath, time.Second*time.Duration(config.GeoMMDBReloadSecs), logger)
+	default:
+		return nil, fmt.Errorf("unknown geolocation provider: %q", name)
+	}
+}
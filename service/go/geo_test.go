@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestIpInfoProvider(t *testing.T, body string) *IpInfoProvider {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return &IpInfoProvider{server.Client(), newTestLogger(), server.URL, ""}
+}
+
+func TestIpInfoProviderLookup(t *testing.T) {
+	provider := newTestIpInfoProvider(t, `{"ip": "8.8.8.8", "city": "Mountain View", "region": "California", "country": "US",
+		"loc": "37.4056,-122.0775", "org": "AS15169 Google LLC", "timezone": "America/Los_Angeles"}`)
+	location, err := provider.Lookup(context.Background(), "8.8.8.8")
+	if err != nil {
+		t.Fatalf("Lookup failed: %s", err)
+	}
+	want := GeoLocation{Country: "United States", CountryCode: "US", Region: "California", City: "Mountain View", Lat: 37.4056, Lon: -122.0775,
+		Timezone: "America/Los_Angeles", ISP: "Google LLC", Org: "Google LLC", ASN: "AS15169"}
+	if *location != want {
+		t.Errorf("Lookup returned %+v, want %+v", *location, want)
+	}
+}
+
+func TestIpInfoProviderLookupWithoutCountry(t *testing.T) {
+	for _, body := range []string{`{"ip": "1.2.3.4"}`, `{"ip": "1.2.3.4", "country": "ZZ"}`} {
+		provider := newTestIpInfoProvider(t, body)
+		// The answer must not be cached as a location with an empty country
+		if location, err := provider.Lookup(context.Background(), "1.2.3.4"); err == nil {
+			t.Errorf("Lookup of %s returned %+v, want an error", body, location)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// HealthResponseData is the body of the health endpoints, checks has the result of each readiness check.
+type HealthResponseData struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// HealthChecker answers the liveness and readiness probes.
+// The service is ready while the database and the cache store answer, the breaker state of each geolocation provider
+// is only reported since the breakers recover by themselves and lookups are still answered from the cache.
+// It is not ready anymore once the shutdown has started so no new requests are routed to it.
+type HealthChecker struct {
+	db       *sql.DB
+	cache    CacheStore
+	logger   *logrus.Logger
+	provider GeoProvider
+	// timeout bounds the pings of a readiness check
+	timeout      time.Duration
+	shuttingDown atomic.Bool
+}
+
+// SetShuttingDown makes the readiness checks fail from now on.
+func (c *HealthChecker) SetShuttingDown() {
+	c.shuttingDown.Store(true)
+}
+
+// healthzHandler tells that the process is alive, it does not check any dependency.
+func (c *HealthChecker) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealthResponse(w, http.StatusOK, HealthResponseData{Status: "ok"})
+}
+
+// readyzHandler tells whether the service can answer the lookups.
+func (c *HealthChecker) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{}
+	ready := true
+	if c.shuttingDown.Load() {
+		checks["shutdown"] = "shutting down"
+		ready = false
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), c.timeout)
+	defer cancel()
+	if err := c.db.PingContext(ctx); err != nil {
+		c.logger.Errorf("Readiness check cannot ping the database, got this error: %s", err)
+		checks["db"] = "unreachable"
+		ready = false
+	} else {
+		checks["db"] = "ok"
+	}
+	if err := c.cache.Ping(ctx); err != nil {
+		c.logger.Errorf("Readiness check cannot ping the %s cache store, got this error: %s", c.cache.Name(), err)
+		checks["cache"] = "unreachable"
+		ready = false
+	} else {
+		checks["cache"] = "ok"
+	}
+
+	// The breakers only move out of open on a lookup, so failing readiness on them would keep the pods out of
+	// the service forever, their state is reported but does not make the service not ready
+	if chain, ok := c.provider.(*ProviderChain); ok {
+		for i, provider := range chain.providers {
+			checks["provider:"+provider.Name()] = chain.breakers[i].State().String()
+		}
+	}
+
+	if !ready {
+		writeHealthResponse(w, http.StatusServiceUnavailable, HealthResponseData{"not ready", checks})
+		return
+	}
+	writeHealthResponse(w, http.StatusOK, HealthResponseData{"ready", checks})
+}
+
+func writeHealthResponse(w http.ResponseWriter, status int, body HealthResponseData) {
+	message, _ := json.Marshal(body)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(message)
+}
+
+func NewHealthChecker(db *sql.DB, cache CacheStore, logger *logrus.Logger, provider GeoProvider, timeout time.Duration) *HealthChecker {
+	return &HealthChecker{db: db, cache: cache, logger: logger, provider: provider, timeout: timeout}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestReadyzChecksCacheStore(t *testing.T) {
+	tests := []struct {
+		name       string
+		pingErr    error
+		wantStatus int
+		wantCache  string
+	}{
+		{"reachable", nil, http.StatusOK, "ok"},
+		{"unreachable", fmt.Errorf("%w: ping: connection refused", ErrCacheUnavailable), http.StatusServiceUnavailable, "unreachable"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+			if err != nil {
+				t.Fatalf("cannot create the sql mock: %s", err)
+			}
+			defer db.Close()
+			mock.ExpectPing()
+			checker := NewHealthChecker(db, &fakeCacheStore{pingErr: test.pingErr}, newTestLogger(), &fakeProvider{name: "test"}, time.Second)
+
+			recorder := httptest.NewRecorder()
+			checker.readyzHandler(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			var body HealthResponseData
+			if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+				t.Fatalf("cannot read the response %q: %s", recorder.Body.String(), err)
+			}
+			if recorder.Code != test.wantStatus || body.Checks["cache"] != test.wantCache || body.Checks["db"] != "ok" {
+				t.Errorf("readyz returned %d with %+v, want %d with the cache %s", recorder.Code, body.Checks, test.wantStatus, test.wantCache)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
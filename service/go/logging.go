@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type requestIDContextKey struct{}
+
+type loggerContextKey struct{}
+
+// redactedHeaders are the request headers whose values are never logged.
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// redactHeaders returns a copy of the headers with the values of the redacted headers replaced.
+func redactHeaders(header http.Header) http.Header {
+	redacted := header.Clone()
+	for _, name := range redactedHeaders {
+		if _, ok := redacted[name]; ok {
+			redacted[name] = []string{"[REDACTED]"}
+		}
+	}
+	return redacted
+}
+
+// newRequestID returns a random id of 32 hex characters.
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// validRequestID reports whether an id given by the caller can be used, it is echoed in headers and logs
+// so it must be short and printable.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestID returns the id of the request given by requestIDMiddleware.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// ctxLogger returns the logger of the request of ctx, which adds the request id to every line,
+// or the given logger if ctx does not belong to a request.
+func ctxLogger(ctx context.Context, logger *logrus.Logger) *logrus.Entry {
+	if entry, ok := ctx.Value(loggerContextKey{}).(*logrus.Entry); ok {
+		return entry
+	}
+	return logrus.NewEntry(logger)
+}
+
+// requestIDMiddleware gives every request an id, the one in the X-Request-ID header if given, which is echoed in the
+// response headers and added to every log line of the request. Every request is logged once it is handled.
+func requestIDMiddleware(logger *logrus.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		entry := logger.WithField("request_id", id)
+		// The trace id links the log lines to the trace of the request, when it is exported
+		span := trace.SpanFromContext(r.Context())
+		if spanContext := span.SpanContext(); spanContext.IsSampled() {
+			entry = entry.WithField("trace_id", spanContext.TraceID().String())
+		}
+		span.SetAttributes(attribute.String("request_id", id))
+		ctx := context.WithValue(r.Context(), requestIDContextKey{}, id)
+		ctx = context.WithValue(ctx, loggerContextKey{}, entry)
+		entry.WithFields(logrus.Fields{
+			"method":  r.Method,
+			"url":     r.URL.String(),
+			"headers": redactHeaders(r.Header),
+		}).Debug("Received request.")
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+		entry.WithFields(logrus.Fields{
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"status":      recorder.status,
+			"duration_ms": time.Since(start).Milliseconds(),
+			"remote_addr": r.RemoteAddr,
+		}).Info("Handled request.")
+	})
+}
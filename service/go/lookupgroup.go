@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// lookupGroup coalesces the concurrent calls with the same key into a single call like singleflight.Group, and
+// cancels the context of the call once every caller waiting on it is gone, e.g. because the clients disconnected.
+type lookupGroup struct {
+	group singleflight.Group
+	mu    sync.Mutex
+	calls map[string]*lookupCall
+}
+
+type lookupCall struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	waiters int
+}
+
+// Do calls fn, or waits for the call in flight with the same key, and returns early with the error of ctx if it is done.
+// The context given to fn keeps the values of the ctx of the first caller, but not its deadline or cancellation.
+func (g *lookupGroup) Do(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*lookupCall{}
+	}
+	call, ok := g.calls[key]
+	if !ok {
+		callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		call = &lookupCall{ctx: callCtx, cancel: cancel}
+		g.calls[key] = call
+	}
+	call.waiters++
+	g.mu.Unlock()
+	defer g.leave(key, call)
+
+	results := g.group.DoChan(key, func() (interface{}, error) {
+		return fn(call.ctx)
+	})
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case result := <-results:
+		return result.Val, result.Err
+	}
+}
+
+// leave cancels the call when its last waiter leaves, and forgets it so the next caller starts a new call.
+func (g *lookupGroup) leave(key string, call *lookupCall) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	call.waiters--
+	if call.waiters > 0 {
+		return
+	}
+	call.cancel()
+	if g.calls[key] == call {
+		delete(g.calls, key)
+		g.group.Forget(key)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// waitForWaiters waits until n callers wait on the call of the key. The callers count as waiters right before they
+// join the call, so it also gives them a moment to join it.
+func waitForWaiters(t *testing.T, g *lookupGroup, key string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		g.mu.Lock()
+		call, ok := g.calls[key]
+		waiters := 0
+		if ok {
+			waiters = call.waiters
+		}
+		g.mu.Unlock()
+		if waiters == n {
+			time.Sleep(10 * time.Millisecond)
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d callers wait on %s, want %d", waiters, key, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// blockingProvider answers the lookups with its location once release is closed, or with the error of the ctx.
+type blockingProvider struct {
+	location *GeoLocation
+	release  chan struct{}
+	calls    atomic.Int32
+}
+
+func (p *blockingProvider) Name() string {
+	return "blocking"
+}
+
+func (p *blockingProvider) Lookup(ctx context.Context, ip string) (*GeoLocation, error) {
+	p.calls.Add(1)
+	select {
+	case <-p.release:
+		return p.location, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestFetchAndCacheCoalescesConcurrentLookups(t *testing.T) {
+	provider := &blockingProvider{location: &GeoLocation{Country: "Canada"}, release: make(chan struct{})}
+	store := &fakeCacheStore{}
+	writeBehind := NewWriteBehindQueue(store, newTestLogger(), 10, 1, 10, time.Hour, time.Second)
+	t.Cleanup(func() { closeWriteBehindQueue(t, writeBehind) })
+	config := &AppConfig{CacheLRUSize: 10, CacheLRUTTLSecs: 60, CacheNegativeTTLSecs: 60}
+	handler := NewApiHandler(newTestLogger(), provider, store, writeBehind, nil, config)
+	coalesced := testutil.ToFloat64(coalescedLookups)
+
+	const callers = 5
+	var wg sync.WaitGroup
+	locations := make([]*GeoLocation, callers)
+	errs := make([]error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			locations[i], errs[i] = handler.fetchAndCache(context.Background(), "/v1/ip", "24.48.0.1")
+		}(i)
+	}
+	waitForWaiters(t, &handler.lookups, "24.48.0.1", callers)
+	close(provider.release)
+	wg.Wait()
+
+	if calls := provider.calls.Load(); calls != 1 {
+		t.Errorf("provider was called %d times, want once", calls)
+	}
+	if got := testutil.ToFloat64(coalescedLookups) - coalesced; got != callers-1 {
+		t.Errorf("coalesced lookups increased by %v, want %d", got, callers-1)
+	}
+	for i := 0; i < callers; i++ {
+		if errs[i] != nil || locations[i] == nil || locations[i].Country != "Canada" {
+			t.Errorf("caller %d got %+v, %v, want the location of the provider", i, locations[i], errs[i])
+		}
+	}
+}
+
+func TestLookupGroupKeepsCallWhenOneWaiterCancels(t *testing.T) {
+	var g lookupGroup
+	release := make(chan struct{})
+	callCtxs := make(chan context.Context, 1)
+	fn := func(ctx context.Context) (interface{}, error) {
+		callCtxs <- ctx
+		select {
+		case <-release:
+			return "Canada", nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan error, 1)
+	go func() {
+		_, err := g.Do(ctx, "24.48.0.1", fn)
+		canceled <- err
+	}()
+	results := make(chan interface{}, 1)
+	go func() {
+		result, _ := g.Do(context.Background(), "24.48.0.1", fn)
+		results <- result
+	}()
+	waitForWaiters(t, &g, "24.48.0.1", 2)
+	callCtx := <-callCtxs
+
+	cancel()
+	if err := <-canceled; !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled caller got %v, want context.Canceled", err)
+	}
+	if err := callCtx.Err(); err != nil {
+		t.Errorf("call context is done with %v while a caller still waits on it", err)
+	}
+	close(release)
+	if result := <-results; result != "Canada" {
+		t.Errorf("remaining caller got %v, want the result of the shared call", result)
+	}
+}
+
+func TestLookupGroupCancelsCallWhenLastWaiterLeaves(t *testing.T) {
+	var g lookupGroup
+	callCtxs := make(chan context.Context, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan error, 1)
+	go func() {
+		_, err := g.Do(ctx, "24.48.0.1", func(ctx context.Context) (interface{}, error) {
+			callCtxs <- ctx
+			<-ctx.Done()
+			return nil, ctx.Err()
+		})
+		canceled <- err
+	}()
+	callCtx := <-callCtxs
+
+	cancel()
+	if err := <-canceled; !errors.Is(err, context.Canceled) {
+		t.Errorf("caller got %v, want context.Canceled", err)
+	}
+	select {
+	case <-callCtx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("call context is not canceled after its last caller left")
+	}
+	g.mu.Lock()
+	_, ok := g.calls["24.48.0.1"]
+	g.mu.Unlock()
+	if ok {
+		t.Errorf("call is still known after its last caller left")
+	}
+
+	// The next caller starts a new call rather than joining the canceled one
+	result, err := g.Do(context.Background(), "24.48.0.1", func(ctx context.Context) (interface{}, error) {
+		return "Canada", nil
+	})
+	if err != nil || result != "Canada" {
+		t.Errorf("next caller got %v, %v, want the result of a new call", result, err)
+	}
+}
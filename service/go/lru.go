@@ -0,0 +1,102 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type lruEntry struct {
+	ip        string
+	item      *CacheItem
+	expiresAt time.Time
+}
+
+// LRUCache is a bounded in-memory cache of ip locations and negative items, the least recently used item is evicted when it is full.
+// A nil *LRUCache is a valid cache that never holds anything, which is used when the memory tier is disabled.
+type LRUCache struct {
+	size  int
+	ttl   time.Duration
+	mu    sync.Mutex
+	items map[string]*list.Element
+	order *list.List
+}
+
+// Get returns the cached item of the ip if it is in the cache and not expired.
+func (c *LRUCache) Get(ip string) (*CacheItem, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.items[ip]
+	if !ok {
+		cacheRequests.WithLabelValues("memory", "miss").Inc()
+		return nil, false
+	}
+	entry := element.Value.(*lruEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.order.Remove(element)
+		delete(c.items, ip)
+		cacheRequests.WithLabelValues("memory", "miss").Inc()
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	cacheRequests.WithLabelValues("memory", "hit").Inc()
+	return entry.item, true
+}
+
+// Add puts the item of the ip in the cache, it expires after the cache ttl or at the expiry of the item if it is earlier.
+// An item with a zero expiry only expires after the cache ttl.
+func (c *LRUCache) Add(ip string, item *CacheItem) {
+	if c == nil {
+		return
+	}
+	expiresAt := item.ExpiresAt
+	ttlExpiresAt := time.Now().Add(c.ttl)
+	if expiresAt.IsZero() || ttlExpiresAt.Before(expiresAt) {
+		expiresAt = ttlExpiresAt
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.items[ip]; ok {
+		entry := element.Value.(*lruEntry)
+		entry.item = item
+		entry.expiresAt = expiresAt
+		c.order.MoveToFront(element)
+		return
+	}
+	c.items[ip] = c.order.PushFront(&lruEntry{ip, item, expiresAt})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry).ip)
+		cacheEvictions.WithLabelValues("memory").Inc()
+	}
+}
+
+// Remove drops the item of the ip from the cache if it is there.
+func (c *LRUCache) Remove(ip string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.items[ip]; ok {
+		c.order.Remove(element)
+		delete(c.items, ip)
+	}
+}
+
+// NewLRUCache creates a cache holding at most size items for ttl each, it returns nil if size is not positive.
+func NewLRUCache(size int, ttl time.Duration) *LRUCache {
+	if size <= 0 {
+		return nil
+	}
+	return &LRUCache{
+		size:  size,
+		ttl:   ttl,
+		items: make(map[string]*list.Element, size),
+		order: list.New(),
+	}
+}
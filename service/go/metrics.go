@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// version is the version of the service, set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+// revision is the vcs revision of the service, set at build time with -ldflags "-X main.revision=..." when the binary
+// is not built from a git checkout, e.g. in the docker image.
+var revision = ""
+
+// Declare Prometheus metrics, they are registered on the registry of NewMetricsRegistry
+var (
+	totalRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "Total number of requests handled by the server",
+		},
+		[]string{"path", "status"},
+	)
+	requestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "Histogram of response durations",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"path"},
+	)
+	webserviceErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_request_webservice_errors_total",
+			Help: "Errors inside the webservice when handling an http request",
+		},
+		[]string{"path", "error"},
+	)
+	providerBreakerState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "geo_provider_circuit_breaker_state",
+			Help: "State of the circuit breaker of each geolocation provider (0: closed, 1: open, 2: half-open)",
+		},
+		[]string{"provider"},
+	)
+	cacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_requests_total",
+			Help: "Cache lookups by cache tier and result (hit or miss)",
+		},
+		[]string{"tier", "result"},
+	)
+	cacheEvictions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_evictions_total",
+			Help: "Items evicted from a cache tier because it was full",
+		},
+		[]string{"tier"},
+	)
+	reservedLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "reserved_ip_lookups_total",
+			Help: "Lookups of ips in reserved ranges, which are answered without a cache or upstream lookup",
+		},
+		[]string{"path", "range"},
+	)
+	providerRateLimitRemaining = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "geo_provider_rate_limit_remaining",
+			Help: "Requests left in the current rate limit window of each rate limited geolocation provider",
+		},
+		[]string{"provider"},
+	)
+	cacheWriteQueueDepth = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "cache_write_queue_depth",
+			Help: "Items waiting in the write-behind queue to be written to the cache store",
+		},
+	)
+	cacheWriteDrops = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_write_dropped_total",
+			Help: "Items dropped from the write-behind queue by reason (full or closed)",
+		},
+		[]string{"reason"},
+	)
+	cacheWriteFailures = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cache_write_failed_total",
+			Help: "Items of the write-behind queue which could not be written to the cache store",
+		},
+	)
+	cacheWriteFlushDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "cache_write_flush_duration_seconds",
+			Help:    "Histogram of the durations of the batch writes of the write-behind queue",
+			Buckets: prometheus.DefBuckets,
+		},
+	)
+	coalescedLookups = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "lookup_coalesced_total",
+			Help: "Upstream lookups which were coalesced with a concurrent lookup of the same ip",
+		},
+	)
+	upstreamRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "geo_provider_request_duration_seconds",
+			Help:    "Histogram of the durations of the http requests to each geolocation provider by status code, or error if none was received",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"provider", "status"},
+	)
+	dbQueryDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "db_query_duration_seconds",
+			Help:    "Histogram of the durations of the queries of the cache store by backend and operation",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"backend", "operation"},
+	)
+	buildInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "service_build_info",
+			Help: "Version and vcs revision the service was built from, the value is always 1",
+		},
+		[]string{"version", "revision", "goversion"},
+	)
+)
+
+// NewMetricsRegistry creates the registry of the service metrics, along with the go runtime, process and build info
+// metrics and the connection pool stats of db labeled with dbName. Each call creates a new registry, so it can be
+// called more than once.
+func NewMetricsRegistry(db *sql.DB, dbName string) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		totalRequests,
+		requestDuration,
+		webserviceErrors,
+		providerBreakerState,
+		cacheRequests,
+		cacheEvictions,
+		reservedLookups,
+		providerRateLimitRemaining,
+		cacheWriteQueueDepth,
+		cacheWriteDrops,
+		cacheWriteFailures,
+		cacheWriteFlushDuration,
+		coalescedLookups,
+		upstreamRequestDuration,
+		dbQueryDuration,
+		buildInfo,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewBuildInfoCollector(),
+		// In use, idle and wait count gauges of the connection pool
+		collectors.NewDBStatsCollector(db, dbName),
+	)
+	buildInfo.WithLabelValues(version, vcsRevision(), runtime.Version()).Set(1)
+	return registry
+}
+
+// vcsRevision returns the vcs revision the binary was built from, or unknown if it was not recorded.
+func vcsRevision() string {
+	if revision != "" {
+		return revision
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
+	}
+	return "unknown"
+}
+
+// observeWithTraceID observes the value with the trace id of ctx as its exemplar if the trace is sampled,
+// so the dashboards can jump from a latency spike to an example trace.
+func observeWithTraceID(ctx context.Context, observer prometheus.Observer, value float64) {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if exemplarObserver, ok := observer.(prometheus.ExemplarObserver); ok && spanContext.IsSampled() {
+		exemplarObserver.ObserveWithExemplar(value, prometheus.Labels{"trace_id": spanContext.TraceID().String()})
+		return
+	}
+	observer.Observe(value)
+}
+
+// instrumentedTransport records the duration and status of the requests sent to a geolocation provider.
+type instrumentedTransport struct {
+	provider string
+	next     http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := t.next.RoundTrip(req)
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(res.StatusCode)
+	}
+	observeWithTraceID(req.Context(), upstreamRequestDuration.WithLabelValues(t.provider, status), time.Since(start).Seconds())
+	return res, err
+}
+
+// instrumentClient returns a copy of the client whose requests are recorded under the provider name.
+func instrumentClient(client *http.Client, provider string) *http.Client {
+	next := client.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	instrumented := *client
+	instrumented.Transport = &instrumentedTransport{provider, next}
+	return &instrumented
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/sirupsen/logrus"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockKey is the key of the postgres advisory lock held while migrating, so replicas do not migrate concurrently.
+const migrationLockKey = 7238716522
+
+// Migration is a versioned schema change, read from the migrations directory.
+// The files are named <version>_<name>.sql and are templates which can use {{ .TableName }} for the cache table name.
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// loadMigrations reads and renders the embedded migrations, sorted by version.
+func loadMigrations(tableName string) ([]Migration, error) {
+	files, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	var migrations []Migration
+	for _, file := range files {
+		name := strings.TrimSuffix(path.Base(file), ".sql")
+		versionPart, namePart, found := strings.Cut(name, "_")
+		version, err := strconv.Atoi(versionPart)
+		if !found || err != nil {
+			return nil, fmt.Errorf("bad migration file name %s, expected <version>_<name>.sql", file)
+		}
+		tmpl, err := template.ParseFS(migrationFiles, file)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse migration %s: %w", file, err)
+		}
+		var rendered strings.Builder
+		if err := tmpl.Execute(&rendered, struct{ TableName string }{tableName}); err != nil {
+			return nil, fmt.Errorf("cannot render migration %s: %w", file, err)
+		}
+		migrations = append(migrations, Migration{version, namePart, rendered.String()})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Migrate applies the embedded migrations which are not yet recorded in the schema_migrations table for the cache table.
+// The migrations are rendered for the cache table, so each cache table has its own applied versions.
+// Each migration runs in its own transaction, and the whole run holds an advisory lock.
+func Migrate(ctx context.Context, db *sql.DB, logger *logrus.Logger, tableName string) error {
+	migrations, err := loadMigrations(tableName)
+	if err != nil {
+		return err
+	}
+	// Advisory locks belong to a session, so the whole run uses a single connection
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot get a connection for migrating: %w", err)
+	}
+	defer conn.Close()
+	logger.Infof("Waiting for the migration lock.")
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1);", migrationLockKey); err != nil {
+		return fmt.Errorf("cannot acquire the migration lock: %w", err)
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1);", migrationLockKey)
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+    table_name TEXT NOT NULL,
+    version INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    applied_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (table_name, version)
+);`)
+	if err != nil {
+		return fmt.Errorf("cannot create the schema_migrations table: %w", err)
+	}
+	applied := map[int]bool{}
+	rows, err := conn.QueryContext(ctx, "SELECT version FROM schema_migrations WHERE table_name = $1;", tableName)
+	if err != nil {
+		return fmt.Errorf("cannot read the applied migrations: %w", err)
+	}
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			rows.Close()
+			return fmt.Errorf("cannot read the applied migrations: %w", err)
+		}
+		applied[version] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("cannot read the applied migrations: %w", err)
+	}
+
+	for _, migration := range migrations {
+		if applied[migration.Version] {
+			continue
+		}
+		logger.Infof("Applying migration %04d_%s.", migration.Version, migration.Name)
+		if err := applyMigration(ctx, conn, tableName, migration); err != nil {
+			return fmt.Errorf("migration %04d_%s failed: %w", migration.Version, migration.Name, err)
+		}
+	}
+	logger.Infof("Database schema is up to date.")
+	return nil
+}
+
+func applyMigration(ctx context.Context, conn *sql.Conn, tableName string, migration Migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, migration.SQL); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (table_name, version, name) VALUES ($1, $2, $3);", tableName, migration.Version, migration.Name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
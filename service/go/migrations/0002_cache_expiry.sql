@@ -0,0 +1,3 @@
+-- Cache expiry, rows without expires_at are treated as expired and refreshed on the next request.
+ALTER TABLE {{ .TableName }} ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE {{ .TableName }} ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ;
@@ -0,0 +1,4 @@
+-- Unique ip, the duplicate rows of each ip are dropped keeping the most recent one, and writes upsert on the ip.
+DELETE FROM {{ .TableName }} a USING {{ .TableName }} b WHERE a.ip = b.ip AND (a.created_at, a.id) < (b.created_at, b.id);
+DROP INDEX IF EXISTS {{ .TableName }}_ip_created_at_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS {{ .TableName }}_ip_key ON {{ .TableName }} (ip);
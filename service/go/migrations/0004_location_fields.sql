@@ -0,0 +1,11 @@
+-- The whole location of the ip is cached, the rows written before are null in the new columns until they are refreshed.
+-- The fields come from the providers and are not bounded, so they are text.
+ALTER TABLE {{ .TableName }} ADD COLUMN IF NOT EXISTS country_code TEXT;
+ALTER TABLE {{ .TableName }} ADD COLUMN IF NOT EXISTS region TEXT;
+ALTER TABLE {{ .TableName }} ADD COLUMN IF NOT EXISTS city TEXT;
+ALTER TABLE {{ .TableName }} ADD COLUMN IF NOT EXISTS lat DOUBLE PRECISION;
+ALTER TABLE {{ .TableName }} ADD COLUMN IF NOT EXISTS lon DOUBLE PRECISION;
+ALTER TABLE {{ .TableName }} ADD COLUMN IF NOT EXISTS timezone TEXT;
+ALTER TABLE {{ .TableName }} ADD COLUMN IF NOT EXISTS isp TEXT;
+ALTER TABLE {{ .TableName }} ADD COLUMN IF NOT EXISTS org TEXT;
+ALTER TABLE {{ .TableName }} ADD COLUMN IF NOT EXISTS asn TEXT;
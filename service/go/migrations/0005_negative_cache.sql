@@ -0,0 +1,2 @@
+-- Negative rows cache the ips the provider has no location for, they have an empty location and the reason of the failure.
+ALTER TABLE {{ .TableName }} ADD COLUMN IF NOT EXISTS fail_reason TEXT;
@@ -0,0 +1,3 @@
+-- The country comes from the providers and is not bounded, a single long name must not fail the whole batch upsert.
+-- Changing varchar to text does not rewrite the table.
+ALTER TABLE {{ .TableName }} ALTER COLUMN country TYPE TEXT;
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+	"github.com/sirupsen/logrus"
+)
+
+// MMDBProvider looks up ips in a local MaxMind GeoLite2/GeoIP2 country or city database.
+// The database file is watched and reloaded whenever it changes on disk.
+type MMDBProvider struct {
+	path    string
+	logger  *logrus.Logger
+	mu      sync.RWMutex
+	reader  *geoip2.Reader
+	modTime time.Time
+	stop    chan struct{}
+}
+
+func (p *MMDBProvider) Name() string {
+	return "mmdb"
+}
+
+// Lookup returns the country of the ip, and its region, city, coordinates and timezone if the database is a city database.
+// The database is local, so the lookup does not wait on the context.
+func (p *MMDBProvider) Lookup(ctx context.Context, ip string) (*GeoLocation, error) {
+	parsedIp := net.ParseIP(ip)
+	if parsedIp == nil {
+		return nil, fmt.Errorf("mmdb lookup: bad ip address %q", ip)
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	// geoip2 returns an empty record without error for the ips which are not in the database
+	if !strings.Contains(p.reader.Metadata().DatabaseType, "City") {
+		record, err := p.reader.Country(parsedIp)
+		if err != nil {
+			return nil, fmt.Errorf("mmdb lookup %s: %w", ip, err)
+		}
+		country, ok := record.Country.Names["en"]
+		if !ok {
+			return nil, &LookupFailedError{"no country found for " + ip}
+		}
+		return &GeoLocation{Country: country, CountryCode: record.Country.IsoCode}, nil
+	}
+	record, err := p.reader.City(parsedIp)
+	if err != nil {
+		return nil, fmt.Errorf("mmdb lookup %s: %w", ip, err)
+	}
+	country, ok := record.Country.Names["en"]
+	if !ok {
+		return nil, &LookupFailedError{"no country found for " + ip}
+	}
+	location := &GeoLocation{
+		Country:     country,
+		CountryCode: record.Country.IsoCode,
+		City:        record.City.Names["en"],
+		Lat:         record.Location.Latitude,
+		Lon:         record.Location.Longitude,
+		Timezone:    record.Location.TimeZone,
+	}
+	if len(record.Subdivisions) > 0 {
+		location.Region = record.Subdivisions[0].Names["en"]
+	}
+	return location, nil
+}
+
+// load opens the database file and swaps it with the currently used reader.
+func (p *MMDBProvider) load(modTime time.Time) error {
+	reader, err := geoip2.Open(p.path)
+	if err != nil {
+		return fmt.Errorf("cannot open mmdb file %s: %w", p.path, err)
+	}
+	p.mu.Lock()
+	old := p.reader
+	p.reader = reader
+	p.modTime = modTime
+	p.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// watch polls the database file every interval and reloads it when its modification time changes.
+func (p *MMDBProvider) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			info, err := os.Stat(p.path)
+			if err != nil {
+				p.logger.Errorf("Cannot stat the mmdb file %s, keeping the loaded database: %s", p.path, err)
+				continue
+			}
+			if info.ModTime().Equal(p.modTime) {
+				continue
+			}
+			if err := p.load(info.ModTime()); err != nil {
+				p.logger.Errorf("Cannot reload the mmdb file, keeping the loaded database: %s", err)
+				continue
+			}
+			p.logger.Infof("Reloaded the mmdb file %s", p.path)
+		}
+	}
+}
+
+// Close stops watching the database file and releases the reader.
+func (p *MMDBProvider) Close() error {
+	close(p.stop)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.reader.Close()
+}
+
+// NewMMDBProvider opens the database at path and reloads it every reloadInterval if it has changed.
+func NewMMDBProvider(path string, reloadInterval time.Duration, logger *logrus.Logger) (*MMDBProvider, error) {
+	if path == "" {
+		return nil, fmt.Errorf("GEO_MMDB_PATH must be set for the mmdb provider")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot stat mmdb file: %w", err)
+	}
+	provider := &MMDBProvider{path: path, logger: logger, stop: make(chan struct{})}
+	if err := provider.load(info.ModTime()); err != nil {
+		return nil, err
+	}
+	if reloadInterval > 0 {
+		go provider.watch(reloadInterval)
+	}
+	return provider, nil
+}
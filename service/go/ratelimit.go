@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateBudget is a client side token bucket of the requests a provider allows per window, e.g. 45 a minute.
+// The bucket refills at the end of each window, and follows the remaining requests and the seconds until the
+// window resets as reported by the provider, so it stays in sync with the budget shared with the other replicas.
+type RateBudget struct {
+	provider string
+	limit    int
+	window   time.Duration
+	// maxWait is how long a lookup is held back for the budget to refill before it fails
+	maxWait time.Duration
+
+	mu        sync.Mutex
+	remaining int
+	resetAt   time.Time
+}
+
+// Take takes a request from the budget. If the budget is used up the call waits for the refill if it is due
+// within maxWait, and otherwise returns an ErrUpstreamRateLimited telling when to retry.
+// The wait ends early with the error of the context if it is done.
+func (b *RateBudget) Take(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		if !now.Before(b.resetAt) {
+			b.remaining = b.limit
+			b.resetAt = now.Add(b.window)
+		}
+		if b.remaining > 0 {
+			b.remaining--
+			b.setRemaining(b.remaining)
+			b.mu.Unlock()
+			return nil
+		}
+		wait := b.resetAt.Sub(now)
+		b.mu.Unlock()
+		if wait > b.maxWait {
+			return &RetryAfterError{ErrUpstreamRateLimited, wait}
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Update syncs the budget with the remaining requests and the seconds until reset in the given headers.
+func (b *RateBudget) Update(header http.Header, remainingHeader string, resetHeader string) {
+	remaining, err := strconv.Atoi(header.Get(remainingHeader))
+	if err != nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.remaining = remaining
+	if secs, err := strconv.Atoi(header.Get(resetHeader)); err == nil {
+		b.resetAt = time.Now().Add(time.Second * time.Duration(secs))
+	}
+	b.setRemaining(remaining)
+}
+
+// Exhaust empties the budget until the given time, it is used when the provider answers that the limit is reached.
+func (b *RateBudget) Exhaust(until time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.remaining = 0
+	if until.After(b.resetAt) {
+		b.resetAt = until
+	}
+	b.setRemaining(0)
+}
+
+func (b *RateBudget) setRemaining(remaining int) {
+	providerRateLimitRemaining.WithLabelValues(b.provider).Set(float64(remaining))
+}
+
+// NewRateBudget creates a full budget of limit requests per window, it returns nil if limit is not positive
+// and the requests are not limited.
+func NewRateBudget(provider string, limit int, window time.Duration, maxWait time.Duration) *RateBudget {
+	if limit <= 0 {
+		return nil
+	}
+	budget := &RateBudget{provider: provider, limit: limit, window: window, maxWait: maxWait, remaining: limit}
+	budget.resetAt = time.Now().Add(window)
+	budget.setRemaining(limit)
+	return budget
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNewRateBudgetUnlimited(t *testing.T) {
+	if budget := NewRateBudget("test", 0, time.Minute, time.Second); budget != nil {
+		t.Errorf("NewRateBudget with no limit returned %+v, want nil", budget)
+	}
+}
+
+func TestRateBudgetTakeUntilUsedUp(t *testing.T) {
+	budget := NewRateBudget("test", 3, time.Minute, time.Second)
+	for i := 0; i < 3; i++ {
+		if err := budget.Take(context.Background()); err != nil {
+			t.Fatalf("Take %d failed: %s", i, err)
+		}
+	}
+	// The refill is due after maxWait, so the request fails at once with the time left until the refill
+	err := budget.Take(context.Background())
+	var retryAfter *RetryAfterError
+	if !errors.As(err, &retryAfter) || !errors.Is(err, ErrUpstreamRateLimited) {
+		t.Fatalf("Take of a used up budget returned %v, want a RetryAfterError", err)
+	}
+	if retryAfter.RetryAfter <= 59*time.Second || retryAfter.RetryAfter > time.Minute {
+		t.Errorf("RetryAfter is %s, want about a minute", retryAfter.RetryAfter)
+	}
+}
+
+func TestRateBudgetRefill(t *testing.T) {
+	budget := NewRateBudget("test", 2, 50*time.Millisecond, time.Second)
+	for i := 0; i < 2; i++ {
+		if err := budget.Take(context.Background()); err != nil {
+			t.Fatalf("Take %d failed: %s", i, err)
+		}
+	}
+	// The refill is due within maxWait, so the request waits for it
+	start := time.Now()
+	if err := budget.Take(context.Background()); err != nil {
+		t.Fatalf("Take waiting for the refill failed: %s", err)
+	}
+	if waited := time.Since(start); waited < 40*time.Millisecond {
+		t.Errorf("Take returned after %s, want it to wait for the refill", waited)
+	}
+	if err := budget.Take(context.Background()); err != nil {
+		t.Errorf("Take after the refill failed: %s", err)
+	}
+}
+
+func TestRateBudgetTakeCanceled(t *testing.T) {
+	budget := NewRateBudget("test", 1, time.Minute, 2*time.Minute)
+	budget.Take(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := budget.Take(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Take with a done context returned %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestRateBudgetUpdate(t *testing.T) {
+	budget := NewRateBudget("test", 45, time.Minute, time.Second)
+
+	// The budget follows the remaining requests and the reset reported by the provider
+	budget.Update(http.Header{"X-Rl": {"0"}, "X-Ttl": {"30"}}, "X-Rl", "X-Ttl")
+	var retryAfter *RetryAfterError
+	if err := budget.Take(context.Background()); !errors.As(err, &retryAfter) {
+		t.Fatalf("Take after the provider reported no requests left returned %v, want a RetryAfterError", err)
+	}
+	if retryAfter.RetryAfter <= 29*time.Second || retryAfter.RetryAfter > 30*time.Second {
+		t.Errorf("RetryAfter is %s, want about 30s", retryAfter.RetryAfter)
+	}
+
+	budget.Update(http.Header{"X-Rl": {"1"}}, "X-Rl", "X-Ttl")
+	if err := budget.Take(context.Background()); err != nil {
+		t.Fatalf("Take after the provider reported a request left failed: %s", err)
+	}
+
+	// Headers which are missing or not numbers are ignored
+	budget.Update(http.Header{"X-Rl": {"many"}, "X-Ttl": {"0"}}, "X-Rl", "X-Ttl")
+	if err := budget.Take(context.Background()); !errors.Is(err, ErrUpstreamRateLimited) {
+		t.Errorf("Take after a bad header returned %v, want ErrUpstreamRateLimited", err)
+	}
+}
+
+func TestRateBudgetExhaust(t *testing.T) {
+	budget := NewRateBudget("test", 45, time.Minute, time.Second)
+	budget.Exhaust(time.Now().Add(2 * time.Minute))
+	var retryAfter *RetryAfterError
+	if err := budget.Take(context.Background()); !errors.As(err, &retryAfter) {
+		t.Fatalf("Take of an exhausted budget returned %v, want a RetryAfterError", err)
+	}
+	if retryAfter.RetryAfter <= time.Minute {
+		t.Errorf("RetryAfter is %s, want about 2m", retryAfter.RetryAfter)
+	}
+}
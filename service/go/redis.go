@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// redisCacheValue is the json value stored under the key of each ip.
+type redisCacheValue struct {
+	Location   GeoLocation `json:"location"`
+	CreatedAt  time.Time   `json:"created_at"`
+	ExpiresAt  time.Time   `json:"expires_at"`
+	FailReason string      `json:"fail_reason,omitempty"`
+}
+
+func (value *redisCacheValue) cacheItem(ip string) *CacheItem {
+	return &CacheItem{Ip: ip, Location: value.Location, CreatedAt: value.CreatedAt, ExpiresAt: value.ExpiresAt, FailReason: value.FailReason}
+}
+
+// RedisCacheStore keeps the cache in Redis, to be shared between the replicas of the service.
+// Keys outlive the item ttl by the stale window so stale items can still be served, and are then dropped by Redis itself.
+type RedisCacheStore struct {
+	client      *redis.Client
+	logger      *logrus.Logger
+	keyPrefix   string
+	ttl         time.Duration
+	negativeTTL time.Duration
+	staleWindow time.Duration
+}
+
+func (s *RedisCacheStore) Name() string {
+	return "redis"
+}
+
+func (s *RedisCacheStore) key(ip string) string {
+	return s.keyPrefix + ":" + ip
+}
+
+func (s *RedisCacheStore) Get(ctx context.Context, ip string) (item *CacheItem, err error) {
+	ctx, done := startQuery(ctx, s.Name(), semconv.DBSystemRedis, "GET", s.keyPrefix)
+	defer func() { done(err) }()
+	raw, err := s.client.Get(ctx, s.key(ip)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, fmt.Errorf("getIpCountryFromCache %s: %w in redis", ip, ErrCacheMiss)
+	}
+	if err != nil {
+		ctxLogger(ctx, s.logger).Errorf("Cannot read key %s from redis: %s", s.key(ip), err)
+		return nil, fmt.Errorf("%w: getIpCountryFromCache %s: %w", ErrCacheUnavailable, ip, err)
+	}
+	var value redisCacheValue
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, fmt.Errorf("%w: getIpCountryFromCache %s: bad value in redis: %w", ErrCacheUnavailable, ip, err)
+	}
+	ctxLogger(ctx, s.logger).Debugf("Found key at redis: {'ip': %s, 'country': %s, 'expires_at': %v}", ip, value.Location.Country, value.ExpiresAt)
+	return value.cacheItem(ip), nil
+}
+
+// GetMany reads the keys of all the given ips in a single MGET.
+func (s *RedisCacheStore) GetMany(ctx context.Context, ips []string) (items map[string]*CacheItem, err error) {
+	items = make(map[string]*CacheItem, len(ips))
+	if len(ips) == 0 {
+		return items, nil
+	}
+	ctx, done := startQuery(ctx, s.Name(), semconv.DBSystemRedis, "MGET", s.keyPrefix)
+	defer func() { done(err) }()
+	keys := make([]string, len(ips))
+	for i, ip := range ips {
+		keys[i] = s.key(ip)
+	}
+	values, err := s.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		ctxLogger(ctx, s.logger).Errorf("Cannot read %d keys from redis: %s", len(keys), err)
+		return nil, fmt.Errorf("%w: getIpCountriesFromCache: %w", ErrCacheUnavailable, err)
+	}
+	for i, raw := range values {
+		rawString, ok := raw.(string)
+		if !ok {
+			continue
+		}
+		var value redisCacheValue
+		if err := json.Unmarshal([]byte(rawString), &value); err != nil {
+			ctxLogger(ctx, s.logger).Errorf("Bad value in redis for key %s: %s", keys[i], err)
+			continue
+		}
+		items[ips[i]] = value.cacheItem(ips[i])
+	}
+	return items, nil
+}
+
+// SetMany writes the keys of all the given items in a single pipeline.
+func (s *RedisCacheStore) SetMany(ctx context.Context, writes []CacheWrite) (err error) {
+	if len(writes) == 0 {
+		return nil
+	}
+	ctx, done := startQuery(ctx, s.Name(), semconv.DBSystemRedis, "SET", s.keyPrefix)
+	defer func() { done(err) }()
+	now := time.Now()
+	pipe := s.client.Pipeline()
+	for _, write := range writes {
+		ttl := s.ttl
+		if write.FailReason != "" {
+			ttl = s.negativeTTL
+		}
+		raw, err := json.Marshal(redisCacheValue{Location: write.Location, CreatedAt: now, ExpiresAt: now.Add(ttl), FailReason: write.FailReason})
+		if err != nil {
+			return fmt.Errorf("%w: writeIpCountryToCache: %w", ErrCacheUnavailable, err)
+		}
+		pipe.Set(ctx, s.key(write.Ip), raw, ttl+s.staleWindow)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("%w: writeIpCountryToCache: %w", ErrCacheUnavailable, err)
+	}
+	return nil
+}
+
+// Delete removes the key of the ip.
+func (s *RedisCacheStore) Delete(ctx context.Context, ip string) (err error) {
+	ctx, done := startQuery(ctx, s.Name(), semconv.DBSystemRedis, "DEL", s.keyPrefix)
+	defer func() { done(err) }()
+	if err := s.client.Del(ctx, s.key(ip)).Err(); err != nil {
+		return fmt.Errorf("%w: deleteIpFromCache %s: %w", ErrCacheUnavailable, ip, err)
+	}
+	return nil
+}
+
+func (s *RedisCacheStore) Ping(ctx context.Context) error {
+	if err := s.client.Ping(ctx).Err(); err != nil {
+		return fmt.Errorf("%w: ping: %w", ErrCacheUnavailable, err)
+	}
+	return nil
+}
+
+// Close closes the connections to Redis.
+func (s *RedisCacheStore) Close() error {
+	return s.client.Close()
+}
+
+func NewRedisCacheStore(client *redis.Client, logger *logrus.Logger, keyPrefix string, ttl time.Duration, negativeTTL time.Duration, staleWindow time.Duration) *RedisCacheStore {
+	return &RedisCacheStore{client, logger, keyPrefix, ttl, negativeTTL, staleWindow}
+}
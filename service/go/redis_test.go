@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+func newTestLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+func newTestRedisCacheStore(t *testing.T) (*RedisCacheStore, *miniredis.Miniredis) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return NewRedisCacheStore(client, newTestLogger(), "ip-cache", time.Hour, 10*time.Minute, 5*time.Minute), server
+}
+
+func TestRedisCacheStoreSetManyAndGet(t *testing.T) {
+	store, server := newTestRedisCacheStore(t)
+	ctx := context.Background()
+	location := GeoLocation{Country: "Canada", CountryCode: "CA", City: "Montreal", Lat: 45.5, Lon: -73.6, ASN: "AS5769"}
+	start := time.Now()
+	err := store.SetMany(ctx, []CacheWrite{
+		{Ip: "24.48.0.1", Location: location},
+		{Ip: "10.0.0.1", FailReason: "private range"},
+	})
+	if err != nil {
+		t.Fatalf("SetMany failed: %s", err)
+	}
+
+	item, err := store.Get(ctx, "24.48.0.1")
+	if err != nil {
+		t.Fatalf("Get failed: %s", err)
+	}
+	if item.Ip != "24.48.0.1" || item.Location != location || item.FailReason != "" {
+		t.Errorf("Get returned %+v, want the location %+v", item, location)
+	}
+	if item.ExpiresAt.Before(start.Add(time.Hour)) || item.ExpiresAt.After(time.Now().Add(time.Hour)) {
+		t.Errorf("ExpiresAt is %s, want an hour from now", item.ExpiresAt)
+	}
+	// The key outlives the item by the stale window
+	if ttl := server.TTL("ip-cache:24.48.0.1"); ttl != time.Hour+5*time.Minute {
+		t.Errorf("key ttl is %s, want %s", ttl, time.Hour+5*time.Minute)
+	}
+
+	negative, err := store.Get(ctx, "10.0.0.1")
+	if err != nil {
+		t.Fatalf("Get of the negative item failed: %s", err)
+	}
+	if _, err := negative.result(); !errors.Is(err, ErrLocationNotFound) {
+		t.Errorf("negative item result is %v, want ErrLocationNotFound", err)
+	}
+	if ttl := server.TTL("ip-cache:10.0.0.1"); ttl != 15*time.Minute {
+		t.Errorf("negative key ttl is %s, want %s", ttl, 15*time.Minute)
+	}
+}
+
+func TestRedisCacheStoreGetMiss(t *testing.T) {
+	store, server := newTestRedisCacheStore(t)
+	ctx := context.Background()
+	if _, err := store.Get(ctx, "24.48.0.1"); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("Get of an unknown ip returned %v, want ErrCacheMiss", err)
+	}
+
+	if err := store.SetMany(ctx, []CacheWrite{{Ip: "24.48.0.1", Location: GeoLocation{Country: "Canada"}}}); err != nil {
+		t.Fatalf("SetMany failed: %s", err)
+	}
+	server.FastForward(time.Hour + 5*time.Minute)
+	if _, err := store.Get(ctx, "24.48.0.1"); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("Get after the key expired returned %v, want ErrCacheMiss", err)
+	}
+}
+
+func TestRedisCacheStoreGetMany(t *testing.T) {
+	store, server := newTestRedisCacheStore(t)
+	ctx := context.Background()
+	err := store.SetMany(ctx, []CacheWrite{
+		{Ip: "24.48.0.1", Location: GeoLocation{Country: "Canada"}},
+		{Ip: "8.8.8.8", Location: GeoLocation{Country: "United States"}},
+	})
+	if err != nil {
+		t.Fatalf("SetMany failed: %s", err)
+	}
+	server.Set("ip-cache:1.1.1.1", "not json")
+
+	items, err := store.GetMany(ctx, []string{"24.48.0.1", "8.8.8.8", "1.1.1.1", "4.4.4.4"})
+	if err != nil {
+		t.Fatalf("GetMany failed: %s", err)
+	}
+	want := map[string]string{"24.48.0.1": "Canada", "8.8.8.8": "United States"}
+	if len(items) != len(want) {
+		t.Errorf("GetMany returned %d items, want %d", len(items), len(want))
+	}
+	for ip, country := range want {
+		if item, ok := items[ip]; !ok || item.Location.Country != country {
+			t.Errorf("GetMany returned %+v for %s, want the country %s", item, ip, country)
+		}
+	}
+
+	if items, err := store.GetMany(ctx, nil); err != nil || len(items) != 0 {
+		t.Errorf("GetMany of no ips returned %v, %v", items, err)
+	}
+}
+
+func TestRedisCacheStoreDelete(t *testing.T) {
+	store, server := newTestRedisCacheStore(t)
+	ctx := context.Background()
+	if err := store.SetMany(ctx, []CacheWrite{{Ip: "24.48.0.1", Location: GeoLocation{Country: "Canada"}}}); err != nil {
+		t.Fatalf("SetMany failed: %s", err)
+	}
+	if err := store.Delete(ctx, "24.48.0.1"); err != nil {
+		t.Fatalf("Delete failed: %s", err)
+	}
+	if server.Exists("ip-cache:24.48.0.1") {
+		t.Errorf("key still exists after Delete")
+	}
+	if err := store.Delete(ctx, "24.48.0.1"); err != nil {
+		t.Errorf("Delete of a missing key failed: %s", err)
+	}
+}
+
+func TestRedisCacheStorePing(t *testing.T) {
+	store, _ := newTestRedisCacheStore(t)
+	if err := store.Ping(context.Background()); err != nil {
+		t.Errorf("Ping failed: %s", err)
+	}
+}
+
+func TestRedisCacheStoreUnavailable(t *testing.T) {
+	store, server := newTestRedisCacheStore(t)
+	server.Close()
+	ctx := context.Background()
+	if _, err := store.Get(ctx, "24.48.0.1"); !errors.Is(err, ErrCacheUnavailable) {
+		t.Errorf("Get returned %v, want ErrCacheUnavailable", err)
+	}
+	if _, err := store.GetMany(ctx, []string{"24.48.0.1"}); !errors.Is(err, ErrCacheUnavailable) {
+		t.Errorf("GetMany returned %v, want ErrCacheUnavailable", err)
+	}
+	if err := store.SetMany(ctx, []CacheWrite{{Ip: "24.48.0.1"}}); !errors.Is(err, ErrCacheUnavailable) {
+		t.Errorf("SetMany returned %v, want ErrCacheUnavailable", err)
+	}
+	if err := store.Delete(ctx, "24.48.0.1"); !errors.Is(err, ErrCacheUnavailable) {
+		t.Errorf("Delete returned %v, want ErrCacheUnavailable", err)
+	}
+	if err := store.Ping(ctx); !errors.Is(err, ErrCacheUnavailable) {
+		t.Errorf("Ping returned %v, want ErrCacheUnavailable", err)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import "net"
+
+// reservedRange is a range of ips which are not routable on the internet, so no geolocation exists for them.
+type reservedRange struct {
+	name    string
+	network *net.IPNet
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+// reservedRanges are checked in order, so the more specific ranges come first.
+var reservedRanges = func() []reservedRange {
+	ranges := []struct {
+		name  string
+		cidrs []string
+	}{
+		{"unspecified", []string{"0.0.0.0/8", "::/128"}},
+		{"loopback", []string{"127.0.0.0/8", "::1/128"}},
+		{"private", []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"}},
+		{"cgnat", []string{"100.64.0.0/10"}},
+		{"link-local", []string{"169.254.0.0/16", "fe80::/10"}},
+		{"documentation", []string{"192.0.2.0/24", "198.51.100.0/24", "203.0.113.0/24", "2001:db8::/32"}},
+		{"benchmarking", []string{"198.18.0.0/15", "2001:2::/48"}},
+		{"multicast", []string{"224.0.0.0/4", "ff00::/8"}},
+		{"broadcast", []string{"255.255.255.255/32"}},
+		{"reserved", []string{"192.0.0.0/24", "240.0.0.0/4", "100::/64"}},
+	}
+	var reserved []reservedRange
+	for _, r := range ranges {
+		for _, cidr := range r.cidrs {
+			reserved = append(reserved, reservedRange{r.name, mustParseCIDR(cidr)})
+		}
+	}
+	return reserved
+}()
+
+// classifyReservedIp returns the name of the reserved range of the ip, e.g. private or loopback,
+// and false if the ip is a public one which can be geolocated.
+func classifyReservedIp(ip string) (string, bool) {
+	parsedIp := net.ParseIP(ip)
+	if parsedIp == nil {
+		return "", false
+	}
+	for _, r := range reservedRanges {
+		if r.network.Contains(parsedIp) {
+			return r.name, true
+		}
+	}
+	return "", false
+}
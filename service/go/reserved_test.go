@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestClassifyReservedIp(t *testing.T) {
+	tests := []struct {
+		ip       string
+		want     string
+		reserved bool
+	}{
+		{"0.0.0.0", "unspecified", true},
+		{"::", "unspecified", true},
+		{"127.0.0.1", "loopback", true},
+		{"::1", "loopback", true},
+		{"10.1.2.3", "private", true},
+		{"172.16.0.1", "private", true},
+		{"172.31.255.255", "private", true},
+		{"192.168.1.1", "private", true},
+		{"fd12:3456::1", "private", true},
+		// ipv4-mapped ipv6 addresses are classified as their ipv4 address
+		{"::ffff:10.0.0.1", "private", true},
+		{"100.64.0.1", "cgnat", true},
+		{"169.254.169.254", "link-local", true},
+		{"fe80::1", "link-local", true},
+		{"192.0.2.1", "documentation", true},
+		{"2001:db8::1", "documentation", true},
+		{"198.18.0.1", "benchmarking", true},
+		{"224.0.0.1", "multicast", true},
+		{"ff02::1", "multicast", true},
+		// broadcast is also in 240.0.0.0/4, the more specific range comes first
+		{"255.255.255.255", "broadcast", true},
+		{"240.0.0.1", "reserved", true},
+		{"8.8.8.8", "", false},
+		{"172.32.0.1", "", false},
+		{"100.128.0.1", "", false},
+		{"2606:4700:4700::1111", "", false},
+		{"not-an-ip", "", false},
+	}
+	for _, tt := range tests {
+		name, reserved := classifyReservedIp(tt.ip)
+		if name != tt.want || reserved != tt.reserved {
+			t.Errorf("classifyReservedIp(%q) = %q, %v, want %q, %v", tt.ip, name, reserved, tt.want, tt.reserved)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type routeContextKey struct{}
+
+// routeMatch is the route matched for a request and the values of its path parameters.
+type routeMatch struct {
+	pattern string
+	params  map[string]string
+}
+
+type route struct {
+	method   string
+	pattern  string
+	segments []string
+	handler  http.Handler
+}
+
+// match returns the path parameters if the path matches the route pattern.
+func (rt *route) match(path string) (map[string]string, bool) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if len(segments) != len(rt.segments) {
+		return nil, false
+	}
+	params := map[string]string{}
+	for i, segment := range rt.segments {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			if segments[i] == "" {
+				return nil, false
+			}
+			params[segment[1:len(segment)-1]] = segments[i]
+		} else if segment != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// Router dispatches requests to handlers by method and path pattern, e.g. GET /v1/ip/{ip}.
+// It records the request metrics labeled by the matched pattern, so the labels stay bounded whatever paths are requested.
+// Requests which match no route get a json 404, or a json 405 if only the method does not match.
+type Router struct {
+	routes []*route
+}
+
+// Handle registers the handler for the method and pattern, a pattern segment in braces matches any single segment.
+func (router *Router) Handle(method string, pattern string, handler http.HandlerFunc) {
+	router.routes = append(router.routes, &route{
+		method:   method,
+		pattern:  pattern,
+		segments: strings.Split(strings.Trim(pattern, "/"), "/"),
+		handler:  handler,
+	})
+}
+
+func (router *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var allowed []string
+	for _, rt := range router.routes {
+		params, ok := rt.match(r.URL.Path)
+		if !ok {
+			continue
+		}
+		if rt.method != r.Method {
+			allowed = append(allowed, rt.method)
+			continue
+		}
+		ctx := context.WithValue(r.Context(), routeContextKey{}, &routeMatch{rt.pattern, params})
+		router.serveRoute(w, r.WithContext(ctx), rt.pattern, rt.handler)
+		return
+	}
+	if len(allowed) > 0 {
+		router.serveRoute(w, r, "unmatched", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			writeApiError(w, r, ErrMethodNotAllowed)
+		}))
+		return
+	}
+	router.serveRoute(w, r, "unmatched", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeApiError(w, r, ErrRouteNotFound)
+	}))
+}
+
+// serveRoute calls the handler and records the request count and duration under the route pattern.
+func (router *Router) serveRoute(w http.ResponseWriter, r *http.Request, pattern string, handler http.Handler) {
+	setSpanRoute(r, pattern)
+	start := time.Now()
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	handler.ServeHTTP(recorder, r)
+	// The duration carries the trace id of the request as exemplar, so a slow bucket links to an example trace
+	observeWithTraceID(r.Context(), requestDuration.WithLabelValues(pattern), time.Since(start).Seconds())
+	totalRequests.WithLabelValues(pattern, fmt.Sprint(recorder.status)).Inc()
+}
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(statusCode int) {
+	s.status = statusCode
+	s.ResponseWriter.WriteHeader(statusCode)
+}
+
+// routePattern returns the pattern of the route which matched the request, used as the path label of the metrics.
+func routePattern(r *http.Request) string {
+	if match, ok := r.Context().Value(routeContextKey{}).(*routeMatch); ok {
+		return match.pattern
+	}
+	return "unmatched"
+}
+
+// pathParam returns the value of a path parameter of the matched route.
+func pathParam(r *http.Request, name string) string {
+	if match, ok := r.Context().Value(routeContextKey{}).(*routeMatch); ok {
+		return match.params[name]
+	}
+	return ""
+}
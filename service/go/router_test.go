@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newTestRouter() *Router {
+	router := &Router{}
+	router.Handle(http.MethodGet, "/v1/ip/{ip}", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(routePattern(r) + " " + pathParam(r, "ip")))
+	})
+	router.Handle(http.MethodPost, "/v1/ip/batch", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(routePattern(r)))
+	})
+	router.Handle(http.MethodDelete, "/admin/cache/{ip}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return router
+}
+
+func TestRouterMatchesRoutes(t *testing.T) {
+	router := newTestRouter()
+	tests := []struct {
+		method string
+		path   string
+		want   string
+	}{
+		{http.MethodGet, "/v1/ip/24.48.0.1", "/v1/ip/{ip} 24.48.0.1"},
+		{http.MethodGet, "/v1/ip/2001:db8::1/", "/v1/ip/{ip} 2001:db8::1"},
+		// The routes are tried in order, so the batch path is an ip for GET
+		{http.MethodGet, "/v1/ip/batch", "/v1/ip/{ip} batch"},
+		{http.MethodPost, "/v1/ip/batch", "/v1/ip/batch"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != http.StatusOK || w.Body.String() != tt.want {
+			t.Errorf("%s %s returned %d %q, want 200 %q", tt.method, tt.path, w.Code, w.Body.String(), tt.want)
+		}
+	}
+}
+
+func TestRouterNotFound(t *testing.T) {
+	router := newTestRouter()
+	for _, path := range []string{"/", "/v1/ip", "/v1/ip/", "/v1/ip/24.48.0.1/extra", "/v2/ip/24.48.0.1"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		var body ApiErrorResponseData
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("GET %s returned a body which is not json: %q", path, w.Body.String())
+		}
+		if w.Code != http.StatusNotFound || body.Code != "NOT_FOUND" {
+			t.Errorf("GET %s returned %d %+v, want 404 NOT_FOUND", path, w.Code, body)
+		}
+	}
+}
+
+func TestRouterMethodNotAllowed(t *testing.T) {
+	router := newTestRouter()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/v1/ip/batch", nil))
+	var body ApiErrorResponseData
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("PUT returned a body which is not json: %q", w.Body.String())
+	}
+	if w.Code != http.StatusMethodNotAllowed || body.Code != "METHOD_NOT_ALLOWED" {
+		t.Errorf("PUT returned %d %+v, want 405 METHOD_NOT_ALLOWED", w.Code, body)
+	}
+	if allow := w.Header().Get("Allow"); allow != "GET, POST" {
+		t.Errorf("Allow header is %q, want %q", allow, "GET, POST")
+	}
+}
+
+func TestRouterMetricsLabels(t *testing.T) {
+	router := newTestRouter()
+	requests := []struct {
+		method string
+		path   string
+	}{
+		{http.MethodGet, "/v1/ip/24.48.0.1"},
+		{http.MethodGet, "/v1/ip/8.8.8.8"},
+		{http.MethodDelete, "/admin/cache/8.8.8.8"},
+		{http.MethodGet, "/random/path/1"},
+		{http.MethodGet, "/random/path/2"},
+		{http.MethodGet, "/admin/cache/8.8.8.8"},
+	}
+	// The counters are global, so only their increase is checked
+	counters := map[[2]string]float64{
+		{"/v1/ip/{ip}", "200"}:       2,
+		{"/admin/cache/{ip}", "204"}: 1,
+		{"unmatched", "404"}:         2,
+		{"unmatched", "405"}:         1,
+	}
+	before := map[[2]string]float64{}
+	for labels := range counters {
+		before[labels] = testutil.ToFloat64(totalRequests.WithLabelValues(labels[0], labels[1]))
+	}
+	for _, request := range requests {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(request.method, request.path, nil))
+	}
+	for labels, want := range counters {
+		if got := testutil.ToFloat64(totalRequests.WithLabelValues(labels[0], labels[1])) - before[labels]; got != want {
+			t.Errorf("http_requests_total{path=%q,status=%q} increased by %v, want %v", labels[0], labels[1], got, want)
+		}
+	}
+}
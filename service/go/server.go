@@ -1,25 +1,46 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
 )
 
 func main() {
 	/* Initialization */
 
-	// Init logging
+	// Init logging, it is json until the level and format of the config are applied
 	logger := logrus.New()
+	logger.SetFormatter(&logrus.JSONFormatter{})
 
 	// Init config
 	config, err := NewAppConfig()
 	if err != nil {
 		logger.Fatalf("Cannot create the config, error: %s", err)
 	}
+	if err := config.ConfigureLogger(logger); err != nil {
+		logger.Fatalf("Cannot configure the logger, error: %s", err)
+	}
+
+	// Init tracing, the spans left are flushed on shutdown
+	tracerProvider, tracerErr := config.CreateTracerProvider(context.Background())
+	if tracerErr != nil {
+		logger.Fatalf("Cannot create the tracer provider, error: %s", tracerErr)
+	}
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
 
 	// Init db
 	db, dbErr := config.CreateDBConnection()
@@ -28,18 +49,114 @@ func main() {
 	}
 	defer db.Close()
 
+	// Migrate the schema, the migrate subcommand only migrates and exits
+	migrateOnly := len(os.Args) > 1 && os.Args[1] == "migrate"
+	if migrateOnly || config.DBMigrateOnStartup {
+		if err := Migrate(context.Background(), db, logger, config.DBTableName); err != nil {
+			logger.Fatalf("Cannot migrate the database, error: %s", err)
+		}
+	}
+	if migrateOnly {
+		return
+	}
+
+	// Init cache store
+	cache, cacheErr := config.CreateCacheStore(db, logger)
+	if cacheErr != nil {
+		logger.Fatalf("Cannot create the cache store, error: %s", cacheErr)
+	}
+	if closer, ok := cache.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	// Init write-behind queue, it is flushed on shutdown
+	writeBehind := config.CreateWriteBehindQueue(cache, logger)
+
 	// Init http client
 	httpClient := http.Client{Timeout: 10 * time.Second}
 	defer httpClient.CloseIdleConnections()
 
+	// Init geolocation provider
+	provider, providerErr := config.CreateGeoProvider(&httpClient, logger)
+	if providerErr != nil {
+		logger.Fatalf("Cannot create the geolocation provider, error: %s", providerErr)
+	}
+	if closer, ok := provider.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	// Init client ip resolver
+	clientIPs, clientIPsErr := config.CreateClientIPResolver()
+	if clientIPsErr != nil {
+		logger.Fatalf("Cannot create the client ip resolver, error: %s", clientIPsErr)
+	}
+
 	/* Webservice */
 	// Create the HTTP web server and listen on the desired port
-	handler := NewApiHandler(db, logger, &httpClient, config)
-	http.HandleFunc("/", handler.ipLocationHandler)
+	handler := NewApiHandler(logger, provider, cache, writeBehind, clientIPs, config)
+	router := &Router{}
+	router.Handle(http.MethodGet, "/v1/ip/{ip}", handler.ipLookupHandler)
+	router.Handle(http.MethodGet, "/v1/me", handler.callerLookupHandler)
+	router.Handle(http.MethodPost, "/v1/lookup/batch", handler.batchLookupHandler)
+	// Kept for the clients of the unversioned api, same as /v1/me
+	router.Handle(http.MethodGet, "/", handler.callerLookupHandler)
+	// The api requests are traced, get a request id and are logged
+	server := &http.Server{Addr: fmt.Sprintf(":%d", config.ServerPort), Handler: tracingMiddleware(requestIDMiddleware(logger, router))}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Fatalf("Failed to start server: %s", err)
+		}
+	}()
+
+	/* Admin */
+	// The metrics, profiles, probes and admin routes are served on their own port, which is not exposed publicly
+	health := NewHealthChecker(db, cache, logger, provider, time.Millisecond*time.Duration(config.ReadinessTimeoutMs))
+	adminRouter := &Router{}
+	adminRouter.Handle(http.MethodDelete, "/admin/cache/{ip}", handler.purgeCacheHandler)
+	adminMux := http.NewServeMux()
+	adminMux.Handle("/admin/", requestIDMiddleware(logger, adminRouter))
 	// Expose the Prometheus metrics endpoint
-	http.Handle("/metrics", promhttp.Handler())
-	httpErr := http.ListenAndServe(fmt.Sprintf(":%d", config.ServerPort), nil)
-	if httpErr != nil {
-		logger.Fatalf("Failed to start server: %s", httpErr)
+	registry := NewMetricsRegistry(db, config.DBName)
+	// OpenMetrics is served to the scrapers asking for it, as the exemplars are only exported in that format
+	adminMux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{Registry: registry, EnableOpenMetrics: true}))
+	// Liveness and readiness probes
+	adminMux.HandleFunc("/healthz", health.healthzHandler)
+	adminMux.HandleFunc("/readyz", health.readyzHandler)
+	// Runtime profiles, e.g. go tool pprof http://localhost:8081/debug/pprof/profile
+	adminMux.HandleFunc("/debug/pprof/", pprof.Index)
+	adminMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	adminMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	adminMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	adminMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	adminServer := &http.Server{Addr: fmt.Sprintf(":%d", config.AdminPort), Handler: adminMux}
+	go func() {
+		if err := adminServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Fatalf("Failed to start admin server: %s", err)
+		}
+	}()
+
+	/* Shutdown */
+	// Stop receiving new requests once not ready, and let the requests in flight finish
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	sig := <-stop
+	health.SetShuttingDown()
+	logger.Infof("Received %s, draining for %d seconds before shutting down.", sig, config.ServerDrainSecs)
+	time.Sleep(time.Second * time.Duration(config.ServerDrainSecs))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(config.ServerShutdownTimeoutSecs))
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Errorf("Cannot finish the requests in flight before the shutdown timeout: %s", err)
+	}
+	// The admin server answers the probes until the api is shut down
+	if err := adminServer.Shutdown(ctx); err != nil {
+		logger.Errorf("Cannot shut down the admin server before the shutdown timeout: %s", err)
+	}
+	if err := writeBehind.Close(ctx); err != nil {
+		logger.Errorf("Cannot flush the write-behind queue before the shutdown timeout: %s", err)
+	}
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		logger.Errorf("Cannot export the spans left before the shutdown timeout: %s", err)
 	}
+	logger.Infof("Server is shut down.")
 }
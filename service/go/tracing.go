@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of the service, it uses the tracer provider set by main, or a no-op one until then.
+var tracer = otel.Tracer("server")
+
+// endSpan ends the span, and records err on it unless it is an answer rather than a failure, e.g. a cache miss.
+func endSpan(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, ErrCacheMiss) && !errors.Is(err, ErrLocationNotFound) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracingMiddleware starts the server span of every request, continuing the trace of the W3C traceparent header if given.
+// The span is named after the method until the router renames it after the matched route.
+func tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+				semconv.UserAgentOriginal(r.UserAgent()),
+			),
+		)
+		defer span.End()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+		span.SetAttributes(semconv.HTTPResponseStatusCode(recorder.status))
+		if recorder.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+	})
+}
+
+// injectTraceContext adds the traceparent header of the span of the request context to the outgoing request.
+func injectTraceContext(req *http.Request) {
+	otel.GetTextMapPropagator().Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+}
+
+// setSpanRoute names the server span of the request after its matched route, so the spans of a route are grouped.
+func setSpanRoute(r *http.Request, pattern string) {
+	span := trace.SpanFromContext(r.Context())
+	span.SetName(r.Method + " " + pattern)
+	span.SetAttributes(semconv.HTTPRoute(pattern))
+}
+
+// Attributes of the lookup spans.
+var (
+	cacheBackendKey = attribute.Key("cache.backend")
+	cacheResultKey  = attribute.Key("cache.result")
+	geoProviderKey  = attribute.Key("geo.provider")
+)
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCreateTracerProviderWithoutEndpointSamplesNothing(t *testing.T) {
+	config := &AppConfig{TracingServiceName: "geo-test", TracingSampleRatio: 1}
+	provider, err := config.CreateTracerProvider(context.Background())
+	if err != nil {
+		t.Fatalf("CreateTracerProvider failed: %s", err)
+	}
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+
+	_, span := provider.Tracer("test").Start(context.Background(), "lookup")
+	defer span.End()
+	if span.SpanContext().IsSampled() {
+		t.Errorf("span is sampled without a trace exporter")
+	}
+}
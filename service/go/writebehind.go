@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// WriteBehindQueue writes the fetched items to the cache store in the background, so the responses do not wait on it.
+// The items are queued on a bounded channel, and a pool of workers writes them in batches of at most batchSize items,
+// or whatever has been queued after flushInterval. Items are dropped when the queue is full.
+type WriteBehindQueue struct {
+	store         CacheStore
+	logger        *logrus.Logger
+	queue         chan CacheWrite
+	batchSize     int
+	flushInterval time.Duration
+	// writeTimeout bounds the write of a batch
+	writeTimeout time.Duration
+
+	// mu guards the queue against being closed while an item is enqueued
+	mu      sync.RWMutex
+	closed  bool
+	workers sync.WaitGroup
+}
+
+// Enqueue queues the item to be written, it returns false if the item was dropped as the queue is full or closed.
+func (q *WriteBehindQueue) Enqueue(write CacheWrite) bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		cacheWriteDrops.WithLabelValues("closed").Inc()
+		return false
+	}
+	// The item is counted before it is sent, so a worker cannot take it off the depth before it is counted
+	cacheWriteQueueDepth.Inc()
+	select {
+	case q.queue <- write:
+		return true
+	default:
+		cacheWriteQueueDepth.Dec()
+		cacheWriteDrops.WithLabelValues("full").Inc()
+		return false
+	}
+}
+
+// worker collects the queued items into batches and writes them until the queue is closed and drained.
+func (q *WriteBehindQueue) worker() {
+	defer q.workers.Done()
+	ticker := time.NewTicker(q.flushInterval)
+	defer ticker.Stop()
+	batch := make([]CacheWrite, 0, q.batchSize)
+	for {
+		select {
+		case write, ok := <-q.queue:
+			if !ok {
+				q.flush(batch)
+				return
+			}
+			cacheWriteQueueDepth.Dec()
+			batch = append(batch, write)
+			if len(batch) >= q.batchSize {
+				q.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			q.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// flush writes the batch to the store, only the last item of each ip is written.
+func (q *WriteBehindQueue) flush(batch []CacheWrite) {
+	if len(batch) == 0 {
+		return
+	}
+	index := make(map[string]int, len(batch))
+	writes := make([]CacheWrite, 0, len(batch))
+	for _, write := range batch {
+		if i, ok := index[write.Ip]; ok {
+			writes[i] = write
+			continue
+		}
+		index[write.Ip] = len(writes)
+		writes = append(writes, write)
+	}
+	// The batch is written apart from the lookups, so its span is the root of a trace linked to theirs
+	links := make([]trace.Link, 0, len(writes))
+	for _, write := range writes {
+		if write.spanContext.IsSampled() {
+			links = append(links, trace.Link{SpanContext: write.spanContext})
+		}
+	}
+	ctx, span := tracer.Start(context.Background(), "writeIpCountryToCache",
+		trace.WithNewRoot(),
+		trace.WithLinks(links...),
+		trace.WithAttributes(cacheBackendKey.String(q.store.Name()), attribute.Int("cache.batch_size", len(writes))),
+	)
+	ctx, cancel := withTimeout(ctx, int(q.writeTimeout.Milliseconds()))
+	defer cancel()
+	start := time.Now()
+	err := q.store.SetMany(ctx, writes)
+	observeWithTraceID(ctx, cacheWriteFlushDuration, time.Since(start).Seconds())
+	endSpan(span, err)
+	if err != nil {
+		q.logger.Errorf("Cannot write a batch of %d items to the cache, got this error: %s", len(writes), err)
+		cacheWriteFailures.Add(float64(len(writes)))
+		return
+	}
+	q.logger.Debugf("Wrote a batch of %d items to the cache.", len(writes))
+}
+
+// Close stops accepting items and waits for the workers to write the queued ones, or for ctx to be done.
+func (q *WriteBehindQueue) Close(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.queue)
+	}
+	q.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// NewWriteBehindQueue starts workers writing the items of a queue of at most size items to the store.
+func NewWriteBehindQueue(store CacheStore, logger *logrus.Logger, size int, workers int, batchSize int, flushInterval time.Duration, writeTimeout time.Duration) *WriteBehindQueue {
+	q := &WriteBehindQueue{
+		store:         store,
+		logger:        logger,
+		queue:         make(chan CacheWrite, max(size, 1)),
+		batchSize:     max(batchSize, 1),
+		flushInterval: max(flushInterval, time.Millisecond),
+		writeTimeout:  writeTimeout,
+	}
+	for i := 0; i < max(workers, 1); i++ {
+		q.workers.Add(1)
+		go q.worker()
+	}
+	return q
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeCacheStore records the batches written with SetMany. If release is set, SetMany waits on it after the batch
+// is recorded and sent to written. Ping fails with pingErr.
+type fakeCacheStore struct {
+	pingErr error
+
+	mu      sync.Mutex
+	batches [][]CacheWrite
+	written chan []CacheWrite
+	release chan struct{}
+}
+
+func (s *fakeCacheStore) Name() string {
+	return "fake"
+}
+
+func (s *fakeCacheStore) Get(ctx context.Context, ip string) (*CacheItem, error) {
+	return nil, ErrCacheMiss
+}
+
+func (s *fakeCacheStore) GetMany(ctx context.Context, ips []string) (map[string]*CacheItem, error) {
+	return map[string]*CacheItem{}, nil
+}
+
+func (s *fakeCacheStore) SetMany(ctx context.Context, writes []CacheWrite) error {
+	s.mu.Lock()
+	s.batches = append(s.batches, append([]CacheWrite(nil), writes...))
+	s.mu.Unlock()
+	if s.written != nil {
+		s.written <- writes
+	}
+	if s.release != nil {
+		<-s.release
+	}
+	return nil
+}
+
+func (s *fakeCacheStore) Delete(ctx context.Context, ip string) error {
+	return nil
+}
+
+func (s *fakeCacheStore) Ping(ctx context.Context) error {
+	return s.pingErr
+}
+
+func (s *fakeCacheStore) Batches() [][]CacheWrite {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.batches
+}
+
+func closeWriteBehindQueue(t *testing.T, q *WriteBehindQueue) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := q.Close(ctx); err != nil {
+		t.Fatalf("Close failed: %s", err)
+	}
+}
+
+func TestWriteBehindQueueWritesLastItemOfEachIp(t *testing.T) {
+	store := &fakeCacheStore{}
+	q := NewWriteBehindQueue(store, newTestLogger(), 10, 1, 3, time.Hour, time.Second)
+	q.Enqueue(CacheWrite{Ip: "24.48.0.1", Location: GeoLocation{Country: "Canada"}})
+	q.Enqueue(CacheWrite{Ip: "8.8.8.8", Location: GeoLocation{Country: "United States"}})
+	q.Enqueue(CacheWrite{Ip: "24.48.0.1", FailReason: "private range"})
+	closeWriteBehindQueue(t, q)
+
+	batches := store.Batches()
+	if len(batches) != 1 || len(batches[0]) != 2 {
+		t.Fatalf("batches are %+v, want a single batch of 2 items", batches)
+	}
+	// The item keeps the place of the first one of its ip
+	if write := batches[0][0]; write.Ip != "24.48.0.1" || write.FailReason != "private range" {
+		t.Errorf("first write is %+v, want the last item of 24.48.0.1", write)
+	}
+	if write := batches[0][1]; write.Ip != "8.8.8.8" {
+		t.Errorf("second write is %+v, want the item of 8.8.8.8", write)
+	}
+}
+
+func TestWriteBehindQueueCloseDrainsQueue(t *testing.T) {
+	store := &fakeCacheStore{}
+	q := NewWriteBehindQueue(store, newTestLogger(), 10, 2, 100, time.Hour, time.Second)
+	ips := []string{"24.48.0.1", "8.8.8.8", "1.1.1.1"}
+	for _, ip := range ips {
+		if !q.Enqueue(CacheWrite{Ip: ip}) {
+			t.Fatalf("Enqueue of %s failed", ip)
+		}
+	}
+	closeWriteBehindQueue(t, q)
+
+	written := map[string]bool{}
+	for _, batch := range store.Batches() {
+		for _, write := range batch {
+			written[write.Ip] = true
+		}
+	}
+	for _, ip := range ips {
+		if !written[ip] {
+			t.Errorf("item of %s was not written before Close returned", ip)
+		}
+	}
+
+	dropped := testutil.ToFloat64(cacheWriteDrops.WithLabelValues("closed"))
+	if q.Enqueue(CacheWrite{Ip: "24.48.0.1"}) {
+		t.Errorf("Enqueue after Close succeeded")
+	}
+	if got := testutil.ToFloat64(cacheWriteDrops.WithLabelValues("closed")) - dropped; got != 1 {
+		t.Errorf("closed drops increased by %v, want 1", got)
+	}
+}
+
+func TestWriteBehindQueueDropsWhenFull(t *testing.T) {
+	store := &fakeCacheStore{written: make(chan []CacheWrite, 1), release: make(chan struct{})}
+	q := NewWriteBehindQueue(store, newTestLogger(), 1, 1, 1, time.Hour, time.Second)
+	depth := testutil.ToFloat64(cacheWriteQueueDepth)
+	dropped := testutil.ToFloat64(cacheWriteDrops.WithLabelValues("full"))
+
+	// The worker takes the first item and blocks on its write, the second item fills the queue
+	q.Enqueue(CacheWrite{Ip: "24.48.0.1"})
+	<-store.written
+	if !q.Enqueue(CacheWrite{Ip: "8.8.8.8"}) {
+		t.Fatalf("Enqueue into the empty queue failed")
+	}
+	if q.Enqueue(CacheWrite{Ip: "1.1.1.1"}) {
+		t.Errorf("Enqueue into the full queue succeeded")
+	}
+	if got := testutil.ToFloat64(cacheWriteDrops.WithLabelValues("full")) - dropped; got != 1 {
+		t.Errorf("full drops increased by %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(cacheWriteQueueDepth) - depth; got != 1 {
+		t.Errorf("queue depth increased by %v, want 1", got)
+	}
+
+	close(store.release)
+	closeWriteBehindQueue(t, q)
+	if got := testutil.ToFloat64(cacheWriteQueueDepth) - depth; got != 0 {
+		t.Errorf("queue depth after Close is %v more than before, want the same", got)
+	}
+	if batches := store.Batches(); len(batches) != 2 {
+		t.Errorf("batches are %+v, want the 2 queued items", batches)
+	}
+}